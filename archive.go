@@ -0,0 +1,632 @@
+package gemdrive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveWriter abstracts over the zip and tar formats so a directory tree
+// can be streamed to either one.
+type archiveWriter interface {
+	AddDir(name string, modTime time.Time) error
+	AddFile(name string, item *Item, modTime time.Time, data io.Reader) error
+	Close() error
+}
+
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, reqPath, format string) {
+
+	token, _ := extractToken(r)
+
+	if token == "" {
+		token = "public"
+	}
+
+	var contentType, ext string
+	switch format {
+	case "zip":
+		contentType, ext = "application/zip", ".zip"
+	case "tar":
+		contentType, ext = "application/x-tar", ".tar"
+	case "tar.gz", "tgz":
+		contentType, ext = "application/gzip", ".tar.gz"
+	default:
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid archive format")
+		return
+	}
+
+	_, isDir, err := statItem(s.backend, reqPath)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil || !isDir {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	rootName := path.Base(strings.TrimSuffix(reqPath, "/"))
+	if rootName == "/" || rootName == "." {
+		rootName = "gemdrive"
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, rootName, ext))
+
+	var archive archiveWriter
+	switch format {
+	case "zip":
+		archive = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	case "tar":
+		archive = &tarArchiveWriter{tw: tar.NewWriter(w)}
+	default:
+		gz := gzip.NewWriter(w)
+		archive = &tarArchiveWriter{tw: tar.NewWriter(gz), gz: gz}
+	}
+
+	// The status has already been sent at this point, so errors can only
+	// be logged and the archive truncated.
+	err = s.writeArchiveDir(archive, token, reqPath, rootName+"/")
+	if err != nil {
+		fmt.Println("archive:", err)
+		return
+	}
+
+	err = archive.Close()
+	if err != nil {
+		fmt.Println("archive:", err)
+	}
+}
+
+func (s *Server) writeArchiveDir(archive archiveWriter, token, dirPath, archivePath string) error {
+
+	// Putting a directory's contents in the archive amounts to listing it
+	if !s.keyAuth.Can(token, dirPath, "list") {
+		return nil
+	}
+
+	listing, err := s.backend.List(dirPath, 1)
+	if err != nil {
+		return err
+	}
+
+	err = archive.AddDir(archivePath, parseModTime(listing.ModTime))
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range listing.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := dirPath + name
+		childArchivePath := archivePath + name
+
+		if strings.HasSuffix(name, "/") {
+			err := s.writeArchiveDir(archive, token, childPath, childArchivePath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !s.keyAuth.CanRead(token, childPath) {
+			continue
+		}
+
+		item, data, err := s.backend.Read(childPath, 0, 0)
+		if err != nil {
+			// Probably deleted since the directory was listed
+			fmt.Println("archive: skipping", childPath, err)
+			continue
+		}
+
+		err = archive.AddFile(childArchivePath, item, parseModTime(item.ModTime), data)
+		data.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseModTime(modTime string) time.Time {
+	t, err := time.Parse(time.RFC3339, modTime)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) AddDir(name string, modTime time.Time) error {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Modified: modTime,
+	}
+	fh.SetMode(os.ModeDir | 0755)
+
+	_, err := a.zw.CreateHeader(fh)
+	return err
+}
+
+func (a *zipArchiveWriter) AddFile(name string, item *Item, modTime time.Time, data io.Reader) error {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	}
+
+	if item.IsExecutable {
+		fh.SetMode(0755)
+	} else {
+		fh.SetMode(0644)
+	}
+
+	fw, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, data)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarArchiveWriter) AddDir(name string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  modTime,
+	})
+}
+
+func (a *tarArchiveWriter) AddFile(name string, item *Item, modTime time.Time, data io.Reader) error {
+	var mode int64 = 0644
+	if item.IsExecutable {
+		mode = 0755
+	}
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     item.Size,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(a.tw, data, item.Size)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	err := a.tw.Close()
+	if err != nil {
+		return err
+	}
+
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+
+	return nil
+}
+
+type extractedDir struct {
+	path    string
+	modTime time.Time
+}
+
+// Uploaded archives are limited in how big they can be, how much they can
+// expand to, and how many entries they can have. Going over any of them fails
+// the upload with 413. Zip files are spooled to disk and checked before
+// anything is written. Tar files are extracted as they stream in, so they're
+// checked along the way and extraction stops at the first entry over a limit,
+// leaving the ones before it in place. The limits can be changed with
+// ExtractMaxSize, ExtractMaxUncompressedSize and ExtractMaxEntries.
+
+const defaultExtractMaxSize = 1024 * 1024 * 1024
+const defaultExtractMaxUncompressedSize = 8 * 1024 * 1024 * 1024
+const defaultExtractMaxEntries = 10000
+
+// extractLimits returns the configured limits, with defaults for any that
+// aren't set.
+func (s *Server) extractLimits() (maxSize, maxUncompressedSize int64, maxEntries int) {
+
+	maxSize = s.config.ExtractMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultExtractMaxSize
+	}
+
+	maxUncompressedSize = s.config.ExtractMaxUncompressedSize
+	if maxUncompressedSize <= 0 {
+		maxUncompressedSize = defaultExtractMaxUncompressedSize
+	}
+
+	maxEntries = s.config.ExtractMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultExtractMaxEntries
+	}
+
+	return maxSize, maxUncompressedSize, maxEntries
+}
+
+// extractArchive unpacks a zip or tar(.gz) request body into the directory
+// at reqPath and reports the outcome of every entry.
+func (s *Server) extractArchive(w http.ResponseWriter, r *http.Request, reqPath, format string, backend WritableBackend) {
+
+	token, _ := extractToken(r)
+
+	if token == "" {
+		token = "public"
+	}
+
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+
+	results := []*ExtractResult{}
+	dirs := []extractedDir{}
+
+	addEntry := func(entry *archiveEntry) {
+
+		result := &ExtractResult{
+			Path: entry.name,
+		}
+		results = append(results, result)
+
+		if entry.unsupported {
+			result.Error = "Unsupported entry type"
+			return
+		}
+
+		// Reject anything that would end up outside of reqPath
+		relPath := path.Clean(entry.name)
+		if entry.name == "" || path.IsAbs(entry.name) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			result.Error = "Invalid path"
+			return
+		}
+
+		entryPath := reqPath + relPath
+
+		eventType := "create"
+		if !entry.isDir {
+			eventType = s.writeEventType(entryPath, overwrite)
+		}
+
+		if !s.keyAuth.Can(token, entryPath, writePerm(eventType)) {
+			result.Error = "Unauthorized"
+			return
+		}
+
+		if entry.isDir {
+			err := backend.MakeDir(entryPath+"/", true)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+
+			// Mod times are set at the end, since writing children
+			// changes them.
+			dirs = append(dirs, extractedDir{entryPath + "/", entry.modTime})
+			s.emit("create", entryPath+"/")
+			return
+		}
+
+		err := backend.MakeDir(path.Dir(entryPath)+"/", true)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+
+		err = backend.Write(entryPath, entry.data, 0, entry.size, overwrite, true)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+
+		s.emit(eventType, entryPath)
+
+		err = backend.SetAttributes(entryPath, entry.modTime, entry.isExecutable)
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+
+	maxSize, maxUncompressedSize, maxEntries := s.extractLimits()
+
+	body := &sizeLimitedReader{
+		reader:    r.Body,
+		remaining: maxSize,
+		err: &Error{
+			HttpCode: 413,
+			Message:  fmt.Sprintf("Tar files can be at most %d bytes", maxSize),
+		},
+	}
+
+	var err error
+	switch format {
+	case "zip":
+		err = s.extractZip(r.Body, r.ContentLength, addEntry)
+	case "tar":
+		if r.ContentLength > maxSize {
+			err = body.err
+			break
+		}
+		err = extractTar(body, maxUncompressedSize, maxEntries, addEntry)
+	case "tar.gz", "tgz":
+		if r.ContentLength > maxSize {
+			err = body.err
+			break
+		}
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(body)
+		if err == nil {
+			err = extractTar(gz, maxUncompressedSize, maxEntries, addEntry)
+		}
+	default:
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid archive format")
+		return
+	}
+
+	// The decompressor and tar reader don't necessarily pass the error
+	// through as is.
+	if err != nil && body.exceeded {
+		err = body.err
+	}
+
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		results = append(results, &ExtractResult{
+			Error: "Reading archive: " + err.Error(),
+		})
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		backend.SetAttributes(dirs[i].path, dirs[i].modTime, true)
+	}
+
+	jsonBody, err := json.Marshal(results)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+type archiveEntry struct {
+	name         string
+	isDir        bool
+	size         int64
+	modTime      time.Time
+	isExecutable bool
+	data         io.Reader
+	unsupported  bool
+}
+
+type addEntryFunc func(entry *archiveEntry)
+
+// extractTar adds entries as they're read, so the limits are checked as it
+// goes.
+func extractTar(reader io.Reader, maxUncompressedSize int64, maxEntries int, addEntry addEntryFunc) error {
+
+	tr := tar.NewReader(reader)
+
+	remaining := maxUncompressedSize
+	entries := 0
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		entries++
+		if entries > maxEntries {
+			return &Error{
+				HttpCode: 413,
+				Message:  fmt.Sprintf("Tar files can have at most %d entries", maxEntries),
+			}
+		}
+
+		// The tar reader won't return more data than the header says
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if header.Size > remaining {
+				return &Error{
+					HttpCode: 413,
+					Message:  fmt.Sprintf("Tar files can extract to at most %d bytes", maxUncompressedSize),
+				}
+			}
+			remaining -= header.Size
+		}
+
+		entry := &archiveEntry{
+			name:    header.Name,
+			modTime: header.ModTime,
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.isDir = true
+		case tar.TypeReg, tar.TypeRegA:
+			entry.size = header.Size
+			entry.isExecutable = header.Mode&0111 == 0111
+			entry.data = tr
+		default:
+			// Links, devices, etc
+			entry.unsupported = true
+		}
+
+		addEntry(entry)
+	}
+}
+
+// Zip files need random access, so the body is buffered to a temporary file.
+// Every entry is checked against the limits before any are added.
+func (s *Server) extractZip(reader io.Reader, contentLength int64, addEntry addEntryFunc) error {
+
+	maxSize, maxUncompressedSize, maxEntries := s.extractLimits()
+
+	tooLarge := &Error{
+		HttpCode: 413,
+		Message:  fmt.Sprintf("Zip files can be at most %d bytes", maxSize),
+	}
+
+	if contentLength > maxSize {
+		return tooLarge
+	}
+
+	tmpFile, err := ioutil.TempFile(s.config.CacheDir, "extract-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	size, err := io.Copy(tmpFile, io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return err
+	}
+
+	if size > maxSize {
+		return tooLarge
+	}
+
+	zr, err := zip.NewReader(tmpFile, size)
+	if err != nil {
+		return err
+	}
+
+	if len(zr.File) > maxEntries {
+		return &Error{
+			HttpCode: 413,
+			Message:  fmt.Sprintf("Zip files can have at most %d entries", maxEntries),
+		}
+	}
+
+	// The zip reader fails entries that decompress to more than their
+	// header says, so the headers can be trusted here.
+	remaining := uint64(maxUncompressedSize)
+	for _, file := range zr.File {
+		if file.UncompressedSize64 > remaining {
+			return &Error{
+				HttpCode: 413,
+				Message:  fmt.Sprintf("Zip files can extract to at most %d bytes", maxUncompressedSize),
+			}
+		}
+		remaining -= file.UncompressedSize64
+	}
+
+	for _, file := range zr.File {
+		mode := file.Mode()
+
+		entry := &archiveEntry{
+			name:    file.Name,
+			modTime: file.Modified,
+		}
+
+		if mode.IsDir() {
+			entry.isDir = true
+			addEntry(entry)
+			continue
+		}
+
+		if !mode.IsRegular() {
+			entry.unsupported = true
+			addEntry(entry)
+			continue
+		}
+
+		data, err := file.Open()
+		if err != nil {
+			return err
+		}
+
+		entry.size = int64(file.UncompressedSize64)
+		entry.isExecutable = mode&0111 == 0111
+		entry.data = data
+
+		addEntry(entry)
+		data.Close()
+	}
+
+	return nil
+}
+
+// sizeLimitedReader fails with err once the underlying reader has more than
+// remaining bytes left to give.
+type sizeLimitedReader struct {
+	reader    io.Reader
+	remaining int64
+	err       error
+	exceeded  bool
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+
+	if l.exceeded {
+		return 0, l.err
+	}
+
+	if l.remaining <= 0 {
+		// Only an error if there's actually more
+		var probe [1]byte
+		n, err := l.reader.Read(probe[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, l.err
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,177 @@
+package gemdrive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func makeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = fw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestExtractZipLimits(t *testing.T) {
+
+	server, baseUrl, masterKey := newTestServer(t)
+
+	server.config.ExtractMaxEntries = 2
+	server.config.ExtractMaxUncompressedSize = 100
+
+	status, body := doRequest(t, "PUT", baseUrl+"/?extract=zip", masterKey, makeZip(t, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+	}))
+	if status != 200 {
+		t.Fatalf("Extracting: got %d %s", status, body)
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+"/a.txt", masterKey, "")
+	if status != 200 {
+		t.Fatalf("Reading extracted file: got %d", status)
+	}
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/?extract=zip", masterKey, makeZip(t, map[string]string{
+		"c.txt": "c",
+		"d.txt": "d",
+		"e.txt": "e",
+	}))
+	if status != 413 {
+		t.Fatalf("Too many entries: got %d, want 413", status)
+	}
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/?extract=zip", masterKey, makeZip(t, map[string]string{
+		"c.txt": strings.Repeat("c", 101),
+	}))
+	if status != 413 {
+		t.Fatalf("Too large uncompressed: got %d, want 413", status)
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+"/c.txt", masterKey, "")
+	if status != 404 {
+		t.Fatalf("File from rejected zip: got %d, want 404", status)
+	}
+
+	server.config.ExtractMaxSize = 10
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/?extract=zip", masterKey, makeZip(t, map[string]string{
+		"f.txt": "f",
+	}))
+	if status != 413 {
+		t.Fatalf("Too large: got %d, want 413", status)
+	}
+}
+
+// makeTarGz takes alternating names and contents, to keep the order.
+func makeTarGz(t *testing.T, files ...string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for i := 0; i < len(files); i += 2 {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     files[i],
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(files[i+1])),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tw.Write([]byte(files[i+1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestExtractTarLimits(t *testing.T) {
+
+	server, baseUrl, masterKey := newTestServer(t)
+
+	server.config.ExtractMaxEntries = 2
+	server.config.ExtractMaxUncompressedSize = 100
+
+	status, body := doRequest(t, "PUT", baseUrl+"/?extract=tar.gz", masterKey, makeTarGz(t,
+		"a.txt", "a",
+		"b.txt", "b",
+	))
+	if status != 200 {
+		t.Fatalf("Extracting: got %d %s", status, body)
+	}
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/?extract=tar.gz", masterKey, makeTarGz(t,
+		"c.txt", "c",
+		"d.txt", "d",
+		"e.txt", "e",
+	))
+	if status != 413 {
+		t.Fatalf("Too many entries: got %d, want 413", status)
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+"/e.txt", masterKey, "")
+	if status != 404 {
+		t.Fatalf("Entry past the limit: got %d, want 404", status)
+	}
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/?extract=tar.gz", masterKey, makeTarGz(t,
+		"f.txt", strings.Repeat("f", 60),
+		"g.txt", strings.Repeat("g", 60),
+	))
+	if status != 413 {
+		t.Fatalf("Too large uncompressed: got %d, want 413", status)
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+"/g.txt", masterKey, "")
+	if status != 404 {
+		t.Fatalf("Entry past the limit: got %d, want 404", status)
+	}
+
+	server.config.ExtractMaxSize = 10
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/?extract=tar.gz", masterKey, makeTarGz(t,
+		"h.txt", "h",
+	))
+	if status != 413 {
+		t.Fatalf("Too large: got %d, want 413", status)
+	}
+}
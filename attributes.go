@@ -0,0 +1,74 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// setAttributes changes the attributes of an existing file or directory
+// without writing to it.
+func (s *Server) setAttributes(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+	key, _ := extractToken(r)
+
+	if key == "" {
+		key = "public"
+	}
+
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	reqData := &SetAttributesRequest{}
+	err = json.Unmarshal(bodyJson, reqData)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if reqData.Path == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "set-attributes: Missing path")
+		return
+	}
+
+	modTime, err := time.Parse(time.RFC3339, reqData.ModTime)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, "set-attributes: Invalid modTime")
+		return
+	}
+
+	reqPath := mappedRoot + reqData.Path
+
+	if !s.keyAuth.Can(key, reqPath, writePerm("modify")) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "set-attributes: Backend does not support writing")
+		return
+	}
+
+	err = backend.SetAttributes(reqPath, modTime, reqData.IsExecutable)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, "set-attributes: "+e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, "set-attributes: "+err.Error())
+		return
+	}
+
+	s.emit("modify", reqPath)
+}
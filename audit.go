@@ -0,0 +1,560 @@
+package gemdrive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every request made with a key is recorded in the audit log, as one JSON
+// object per line. Keys are recorded by ID, never the key itself. The log is
+// rotated once it reaches AuditMaxSize, keeping AuditMaxFiles old logs as
+// audit.log.1 (the newest) through audit.log.N. Entries are written by a
+// goroutine of their own, so requests don't wait on the disk or on rotation.
+
+const defaultAuditMaxSize = 10 * 1024 * 1024
+const defaultAuditMaxFiles = 5
+
+// How many entries can be waiting to be written before requests have to
+// wait for them.
+const auditQueueSize = 1024
+
+const defaultAuditQueryLimit = 1000
+const maxAuditQueryLimit = 10000
+
+type AuditEntry struct {
+	Time       string `json:"time"`
+	KeyId      string `json:"keyId,omitempty"`
+	Signed     bool   `json:"signed,omitempty"`
+	Privilege  string `json:"privilege,omitempty"`
+	Operation  string `json:"operation"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Status     int    `json:"status"`
+	BytesIn    int64  `json:"bytesIn"`
+	BytesOut   int64  `json:"bytesOut"`
+	DurationMs int64  `json:"durationMs"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+type auditLog struct {
+	mut      sync.Mutex
+	queue    chan *auditWrite
+	stopped  chan struct{}
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+func newAuditLog(path string, maxSize int64, maxFiles int) (*auditLog, error) {
+
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultAuditMaxFiles
+	}
+
+	l := &auditLog{
+		queue:    make(chan *auditWrite, auditQueueSize),
+		stopped:  make(chan struct{}),
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	go l.run()
+
+	return l, nil
+}
+
+// An auditWrite is either a line to write, or a request to be told once
+// everything before it has been written.
+type auditWrite struct {
+	line []byte
+	done chan struct{}
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *auditLog) write(entry *AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.queue <- &auditWrite{line: line}
+}
+
+// sync waits for the entries written so far to reach the file.
+func (l *auditLog) sync() {
+	done := make(chan struct{})
+	l.queue <- &auditWrite{done: done}
+	<-done
+}
+
+func (l *auditLog) run() {
+	for w := range l.queue {
+		if w.done != nil {
+			close(w.done)
+			continue
+		}
+
+		l.writeLine(w.line)
+	}
+
+	close(l.stopped)
+}
+
+// Close writes out whatever is still queued and closes the file. Nothing
+// can be written after that.
+func (l *auditLog) Close() error {
+	close(l.queue)
+	<-l.stopped
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *auditLog) writeLine(line []byte) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			log.Printf("audit: rotating log failed: %v", err)
+		}
+	}
+
+	if l.file == nil {
+		return
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	os.Remove(l.rotatedPath(l.maxFiles))
+
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+	}
+
+	err := os.Rename(l.path, l.rotatedPath(1))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *auditLog) rotatedPath(i int) string {
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// query returns the last limit entries that match, oldest first.
+func (l *auditLog) query(match func(*AuditEntry) bool, limit int) ([]*AuditEntry, error) {
+
+	l.sync()
+
+	paths := []string{}
+	for i := l.maxFiles; i >= 1; i-- {
+		paths = append(paths, l.rotatedPath(i))
+	}
+	paths = append(paths, l.path)
+
+	// Opened while holding the lock so a rotation can't shift files
+	// around between opening one and the next. What's open stays readable
+	// whatever happens to it afterwards.
+	files := []*os.File{}
+	closeAll := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+
+	l.mut.Lock()
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			l.mut.Unlock()
+			closeAll()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	l.mut.Unlock()
+
+	defer closeAll()
+
+	entries := []*AuditEntry{}
+
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			entry := &AuditEntry{}
+			err := json.Unmarshal(scanner.Bytes(), entry)
+			if err != nil || !match(entry) {
+				continue
+			}
+
+			entries = append(entries, entry)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+
+		err := scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+type auditContextKey struct{}
+
+// auditRecord holds what's known about a request before it's handled. The
+// key is identified up front, since the request may well revoke it.
+type auditRecord struct {
+	keyAuth    *KeyAuth
+	operation  string
+	target     string
+	signed     bool
+	identified bool
+	keyId      string
+	privilege  string
+	body       *auditBody
+}
+
+func (rec *auditRecord) identify(key string) {
+	rec.identified = true
+	rec.signed = isSignedToken(key)
+	rec.keyId, rec.privilege = rec.keyAuth.Identify(key, rec.target)
+}
+
+// setAuditKey is for handlers that authenticate some other way than
+// extractToken, like S3.
+func setAuditKey(r *http.Request, keyId string, keyData *KeyData) {
+	if rec, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		rec.identified = true
+		rec.keyId = keyId
+		if rec.target != "" {
+			rec.privilege = keyData.perms(rec.target).String()
+		}
+	}
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Needed for the event stream
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type auditBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// beginAudit wraps the request and response so the amount of data going each
+// way can be recorded once the request is done.
+func (s *Server) beginAudit(w http.ResponseWriter, r *http.Request, mappedRoot string) (*auditResponseWriter, *http.Request) {
+
+	operation, target := auditOperation(r, mappedRoot)
+
+	rec := &auditRecord{
+		keyAuth:   s.keyAuth,
+		operation: operation,
+		target:    target,
+	}
+
+	if token, err := extractToken(r); err == nil && !isS3Request(r) {
+		rec.identify(token)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec))
+
+	if r.Body != nil {
+		rec.body = &auditBody{ReadCloser: r.Body}
+		r.Body = rec.body
+	}
+
+	return &auditResponseWriter{ResponseWriter: w}, r
+}
+
+func (s *Server) endAudit(w *auditResponseWriter, r *http.Request, start time.Time) {
+
+	rec, _ := r.Context().Value(auditContextKey{}).(*auditRecord)
+	if rec == nil || !rec.identified {
+		return
+	}
+
+	entry := &AuditEntry{
+		Time:       start.UTC().Format(time.RFC3339),
+		KeyId:      rec.keyId,
+		Signed:     rec.signed,
+		Privilege:  rec.privilege,
+		Operation:  rec.operation,
+		Method:     r.Method,
+		Path:       rec.target,
+		Status:     w.status,
+		BytesOut:   w.bytes,
+		DurationMs: time.Since(start).Milliseconds(),
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	if entry.Status == 0 {
+		entry.Status = 200
+	}
+
+	if rec.body != nil {
+		entry.BytesIn = rec.body.bytes
+	}
+
+	if entry.Path == "" {
+		entry.Path = r.URL.Path
+	}
+
+	s.audit.write(entry)
+}
+
+// auditOperation names the kind of request, and for requests that act on a
+// single path returns that path.
+func auditOperation(r *http.Request, mappedRoot string) (string, string) {
+
+	reqPath := r.URL.Path
+
+	if isS3Request(r) {
+		return "s3", mappedRoot + reqPath
+	}
+
+	if !strings.HasPrefix(reqPath, "/gemdrive/") {
+		return "file", mappedRoot + reqPath
+	}
+
+	gemReq := reqPath[len("/gemdrive/"):]
+	operation := strings.SplitN(gemReq, "/", 2)[0]
+
+	switch operation {
+	case "index":
+		target := strings.TrimPrefix(gemReq, "index")
+		target = strings.TrimSuffix(target, "list.json")
+		target = strings.TrimSuffix(target, "tree.json")
+		return operation, mappedRoot + target
+	case "images":
+		parts := strings.SplitN(gemReq, "/", 3)
+		if len(parts) == 3 {
+			return operation, mappedRoot + "/" + parts[2]
+		}
+	case "events", "webdav":
+		return operation, mappedRoot + strings.TrimPrefix(gemReq, operation)
+	}
+
+	return operation, ""
+}
+
+// Identify returns the ID of the key a token belongs to, and what the key is
+// allowed to do at pathStr if given. Signed tokens are identified as the key
+// that signed them.
+func (a *KeyAuth) Identify(token, pathStr string) (string, string) {
+
+	var id string
+
+	if isSignedToken(token) {
+		u, _, err := a.verifySigned(token)
+		if err != nil {
+			return "", ""
+		}
+		id = u.KeyId
+	} else {
+		var err error
+		id, err = a.db.GetKeyId(token)
+		if err != nil {
+			return "", ""
+		}
+	}
+
+	if pathStr == "" {
+		return id, ""
+	}
+
+	keyData, err := a.keyData(token, pathStr)
+	if err != nil {
+		return id, "deny"
+	}
+
+	return id, keyData.perms(pathStr).String()
+}
+
+func (s *Server) serveAudit(w http.ResponseWriter, r *http.Request) {
+
+	key, _ := extractToken(r)
+
+	if !s.isMasterKey(key) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := defaultAuditQueryLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid limit")
+			return
+		}
+		if limit > maxAuditQueryLimit {
+			limit = maxAuditQueryLimit
+		}
+	}
+
+	var since, until time.Time
+	for param, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+
+		var err error
+		*t, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid "+param)
+			return
+		}
+	}
+
+	keyIdParam := query.Get("keyId")
+	pathParam := query.Get("path")
+	operationParam := query.Get("operation")
+
+	match := func(entry *AuditEntry) bool {
+		if keyIdParam != "" && entry.KeyId != keyIdParam {
+			return false
+		}
+		if pathParam != "" && !strings.HasPrefix(entry.Path, pathParam) {
+			return false
+		}
+		if operationParam != "" && entry.Operation != operationParam {
+			return false
+		}
+
+		if !since.IsZero() || !until.IsZero() {
+			t, err := time.Parse(time.RFC3339, entry.Time)
+			if err != nil {
+				return false
+			}
+			if !since.IsZero() && t.Before(since) {
+				return false
+			}
+			if !until.IsZero() && !t.Before(until) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	entries, err := s.audit.query(match, limit)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	jsonBody, err := json.Marshal(entries)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
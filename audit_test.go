@@ -0,0 +1,92 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogRecordsKeyIdsOnly(t *testing.T) {
+
+	server, baseUrl, masterKey := newTestServer(t)
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "hello")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	status, body := doRequest(t, "GET", baseUrl+"/gemdrive/audit", masterKey, "")
+	if status != 200 {
+		t.Fatalf("Querying audit log: %d %s", status, body)
+	}
+
+	masterKeyId, _ := splitKeyId(masterKey)
+	if !strings.Contains(body, `"keyId":"`+masterKeyId+`"`) {
+		t.Fatalf("Audit log doesn't have the write: %s", body)
+	}
+
+	logBytes, err := ioutil.ReadFile(filepath.Join(server.config.DataDir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := strings.TrimPrefix(masterKey, masterKeyId+".")
+	if strings.Contains(string(logBytes), secret) || strings.Contains(string(logBytes), secret[:8]) {
+		t.Fatal("Audit log contains part of the key")
+	}
+}
+
+func TestAuditLogCloseWritesQueuedEntries(t *testing.T) {
+
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := newAuditLog(logPath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		l.write(&AuditEntry{Operation: "read", Path: "/a.txt"})
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logBytes, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(logBytes), "\n"); lines != 100 {
+		t.Fatalf("Got %d entries after Close, want 100", lines)
+	}
+}
+
+func TestAuditLogQueryWhileRotating(t *testing.T) {
+
+	l, err := newAuditLog(filepath.Join(t.TempDir(), "audit.log"), 1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			l.write(&AuditEntry{Operation: "read", Path: "/a.txt"})
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		_, err := l.query(func(*AuditEntry) bool { return true }, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,160 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltKeysBucket  = []byte("keys")
+	boltUsersBucket = []byte("users")
+	boltMetaBucket  = []byte("meta")
+	boltVersionKey  = []byte("version")
+)
+
+// BoltStore keeps keys and users in an embedded bbolt database, so changes
+// only write the records involved.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var (
+	_ Store = (*BoltStore)(nil)
+)
+
+func NewBoltStore(path string) (*BoltStore, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltKeysBucket, boltUsersBucket, boltMetaBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		db: db,
+	}, nil
+}
+
+func (s *BoltStore) Load() (*StoreData, error) {
+
+	data := &StoreData{
+		Keys:  make(map[string]*KeyData),
+		Users: make(map[string]*UserData),
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version := tx.Bucket(boltMetaBucket).Get(boltVersionKey)
+		if version != nil {
+			err := json.Unmarshal(version, &data.Version)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Bucket(boltKeysBucket).ForEach(func(k, v []byte) error {
+			keyData := &KeyData{}
+			err := json.Unmarshal(v, keyData)
+			if err != nil {
+				return err
+			}
+			data.Keys[string(k)] = keyData
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			userData := &UserData{}
+			err := json.Unmarshal(v, userData)
+			if err != nil {
+				return err
+			}
+			data.Users[string(k)] = userData
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *BoltStore) Commit(changes *StoreChanges) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(boltKeysBucket)
+		users := tx.Bucket(boltUsersBucket)
+
+		if changes.Version != 0 {
+			value, err := json.Marshal(changes.Version)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Bucket(boltMetaBucket).Put(boltVersionKey, value)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, id := range changes.DeleteKeys {
+			err := keys.Delete([]byte(id))
+			if err != nil {
+				return err
+			}
+		}
+
+		for id, keyData := range changes.PutKeys {
+			value, err := json.Marshal(keyData)
+			if err != nil {
+				return err
+			}
+
+			err = keys.Put([]byte(id), value)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, username := range changes.DeleteUsers {
+			err := users.Delete([]byte(username))
+			if err != nil {
+				return err
+			}
+		}
+
+		for username, userData := range changes.PutUsers {
+			value, err := json.Marshal(userData)
+			if err != nil {
+				return err
+			}
+
+			err = users.Put([]byte(username), value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
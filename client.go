@@ -0,0 +1,448 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a GemDrive server over HTTP. Paths are the same as on the
+// server. When the server responds with an error it's returned as an *Error
+// with the status code and message the server sent.
+type Client struct {
+	baseUrl    string
+	key        string
+	httpClient *http.Client
+}
+
+// WriteOptions are passed to Write and Patch. Without Overwrite, writing to
+// a file that already exists fails with 409. If ModTime is zero the file
+// gets the time of the write.
+type WriteOptions struct {
+	Overwrite    bool
+	ModTime      time.Time
+	IsExecutable bool
+}
+
+// NewClient takes the URL the server is reachable at, e.g.
+// https://example.com, and the key to use. An empty key accesses the
+// server publicly.
+func NewClient(serverUrl, key string) (*Client, error) {
+
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Server URL must be http or https")
+	}
+
+	return &Client{
+		baseUrl:    u.Scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/"),
+		key:        key,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+func (c *Client) url(reqPath string) string {
+	return c.baseUrl + (&url.URL{Path: reqPath}).EscapedPath()
+}
+
+// request sends a request to the server, and converts error responses to an
+// *Error with the same code.
+func (c *Client) request(method, reqUrl string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, reqUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		// The client closes bodies that can be closed, and they belong to
+		// the caller.
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = length
+		if length == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+		return nil, &Error{
+			HttpCode: resp.StatusCode,
+			Message:  strings.TrimSpace(string(msg)),
+		}
+	}
+
+	return resp, nil
+}
+
+// post sends a JSON request to one of the /gemdrive/ endpoints and returns
+// the response body.
+func (c *Client) post(endpoint string, reqData interface{}) ([]byte, error) {
+
+	jsonBody, err := json.Marshal(reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	resp, err := c.request("POST", c.url("/gemdrive/"+endpoint), bytes.NewReader(jsonBody), int64(len(jsonBody)), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *Client) getItem(reqUrl string) (*Item, error) {
+
+	resp, err := c.request("GET", reqUrl, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	item := &Item{}
+	err = json.NewDecoder(resp.Body).Decode(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// List returns a directory and its immediate children.
+func (c *Client) List(dir string) (*Item, error) {
+	return c.getItem(c.url("/gemdrive/index" + dirPath(dir) + "list.json"))
+}
+
+// Tree returns a directory and everything under it, down to depth levels. A
+// depth of 0 means no limit.
+func (c *Client) Tree(dir string, depth int) (*Item, error) {
+
+	reqUrl := c.url("/gemdrive/index" + dirPath(dir) + "tree.json")
+	if depth != 0 {
+		reqUrl += "?depth=" + strconv.Itoa(depth)
+	}
+
+	return c.getItem(reqUrl)
+}
+
+// Read works like Backend.Read. A length of 0 reads to the end of the file,
+// and the returned item has the size of the whole file.
+func (c *Client) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+
+	if offset < 0 || length < 0 {
+		return nil, nil, &Error{
+			HttpCode: 416,
+			Message:  "Invalid range",
+		}
+	}
+
+	header := http.Header{}
+	if length != 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset != 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.request("GET", c.url(reqPath), nil, 0, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != 206 && header.Get("Range") != "" {
+		resp.Body.Close()
+		return nil, nil, errors.New("Server ignored Range")
+	}
+
+	item, err := responseItem(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+
+	return item, resp.Body, nil
+}
+
+// ReadFrom continues reading a file from offset to its end. ifRange is the
+// validator returned when the read was started. If the file has changed
+// since, the whole file is returned instead and start is 0. The returned
+// validator can be used to continue this read later.
+func (c *Client) ReadFrom(reqPath string, offset int64, ifRange string) (item *Item, data io.ReadCloser, start int64, validator string, err error) {
+
+	if offset < 0 {
+		return nil, nil, 0, "", &Error{
+			HttpCode: 416,
+			Message:  "Invalid range",
+		}
+	}
+
+	header := http.Header{}
+	if offset != 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if ifRange != "" {
+			header.Set("If-Range", ifRange)
+		}
+	}
+
+	resp, err := c.request("GET", c.url(reqPath), nil, 0, header)
+	if err != nil {
+		return nil, nil, 0, "", err
+	}
+
+	item, err = responseItem(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, 0, "", err
+	}
+
+	if resp.StatusCode == 206 {
+		start = offset
+	}
+
+	// Weak ETags can't be used with If-Range
+	validator = resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	return item, resp.Body, start, validator, nil
+}
+
+// responseItem gets a file's attributes from the response to reading it.
+func responseItem(resp *http.Response) (*Item, error) {
+
+	item := &Item{
+		Size:         resp.ContentLength,
+		IsExecutable: resp.Header.Get("GemDrive-IsExecutable") == "true",
+	}
+
+	if resp.StatusCode == 206 {
+		// Content-Range: bytes start-end/size
+		contentRange := resp.Header.Get("Content-Range")
+		slash := strings.LastIndex(contentRange, "/")
+		size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+		if slash == -1 || err != nil {
+			return nil, errors.New("Invalid Content-Range from server")
+		}
+		item.Size = size
+	}
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err == nil {
+		item.ModTime = modTime.UTC().Format(time.RFC3339)
+	}
+
+	return item, nil
+}
+
+// Write creates or replaces a file. If length is -1 data is saved to a
+// temporary file first to find out how long it is.
+func (c *Client) Write(reqPath string, data io.Reader, length int64, opts *WriteOptions) error {
+	return c.write("PUT", reqPath, data, 0, length, opts)
+}
+
+// Patch writes data into a file at offset, creating the file if needed.
+func (c *Client) Patch(reqPath string, data io.Reader, offset, length int64, opts *WriteOptions) error {
+	return c.write("PATCH", reqPath, data, offset, length, opts)
+}
+
+func (c *Client) write(method, reqPath string, data io.Reader, offset, length int64, opts *WriteOptions) error {
+
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
+	if length < 0 {
+		tmpFile, err := ioutil.TempFile("", "gemdrive-client-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		length, err = io.Copy(tmpFile, data)
+		if err != nil {
+			return err
+		}
+
+		_, err = tmpFile.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+
+		data = tmpFile
+	}
+
+	query := url.Values{}
+	header := http.Header{}
+
+	if method == "PATCH" {
+		query.Set("offset", strconv.FormatInt(offset, 10))
+		// PATCH always writes into existing files
+		if !opts.Overwrite {
+			header.Set("If-None-Match", "*")
+		}
+	} else if opts.Overwrite {
+		query.Set("overwrite", "true")
+	}
+
+	if !opts.ModTime.IsZero() {
+		query.Set("mod-time", opts.ModTime.UTC().Format(time.RFC3339))
+	}
+
+	if opts.IsExecutable {
+		query.Set("is-executable", "true")
+	}
+
+	reqUrl := c.url(reqPath)
+	if len(query) > 0 {
+		reqUrl += "?" + query.Encode()
+	}
+
+	resp, err := c.request(method, reqUrl, data, length, header)
+	if e, ok := err.(*Error); ok && e.HttpCode == 412 {
+		return &Error{
+			HttpCode: 409,
+			Message:  "File exists",
+		}
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// MakeDir creates a directory. With recursive any missing parents are
+// created too, and it isn't an error if the directory already exists.
+func (c *Client) MakeDir(dir string, recursive bool) error {
+
+	reqUrl := c.url(dirPath(dir))
+	if recursive {
+		reqUrl += "?recursive=true"
+	}
+
+	resp, err := c.request("PUT", reqUrl, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (c *Client) Delete(reqPath string, recursive bool) error {
+
+	reqUrl := c.url(reqPath)
+	if recursive {
+		reqUrl += "?recursive=true"
+	}
+
+	resp, err := c.request("DELETE", reqUrl, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (c *Client) SetAttributes(reqPath string, modTime time.Time, isExecutable bool) error {
+	_, err := c.post("set-attributes", &SetAttributesRequest{
+		Path:         reqPath,
+		ModTime:      modTime.UTC().Format(time.RFC3339),
+		IsExecutable: isExecutable,
+	})
+	return err
+}
+
+func (c *Client) Move(srcPath, dstPath string, overwrite bool) error {
+	_, err := c.post("move", &MoveRequest{
+		Source:      srcPath,
+		Destination: dstPath,
+		Overwrite:   overwrite,
+	})
+	return err
+}
+
+func (c *Client) Copy(srcPath, dstPath string, overwrite bool) error {
+	_, err := c.post("copy", &CopyRequest{
+		Source:      srcPath,
+		Destination: dstPath,
+		Overwrite:   overwrite,
+	})
+	return err
+}
+
+// CreateKey creates a child of the client's key and returns it. Only
+// Privileges, ExpiresAt, NotBefore and MaxUses are used.
+func (c *Client) CreateKey(keyData *KeyData) (string, error) {
+	newKey, err := c.post("create-key", keyData)
+	if err != nil {
+		return "", err
+	}
+	return string(newKey), nil
+}
+
+// Sign returns a URL that can be used without a key to do what signReq
+// says, on behalf of the client's key.
+func (c *Client) Sign(signReq *SignRequest) (string, error) {
+	signed, err := c.post("sign", signReq)
+	if err != nil {
+		return "", err
+	}
+	return c.baseUrl + string(signed), nil
+}
+
+// RemoteGet has the server download a URL into a file.
+func (c *Client) RemoteGet(reqData *RemoteGetRequest) error {
+	_, err := c.post("remote-get", reqData)
+	return err
+}
+
+// GetImage returns a thumbnail of an image, scaled so its longer side is
+// size pixels.
+func (c *Client) GetImage(reqPath string, size int) (io.ReadCloser, error) {
+
+	reqUrl := c.url(fmt.Sprintf("/gemdrive/images/%d%s", size, reqPath))
+
+	resp, err := c.request("GET", reqUrl, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
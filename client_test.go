@@ -0,0 +1,307 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (*Client, string) {
+	t.Helper()
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	client, err := NewClient(baseUrl, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, baseUrl
+}
+
+func expectErrorCode(t *testing.T, what string, err error, code int) {
+	t.Helper()
+
+	e, ok := err.(*Error)
+	if !ok || e.HttpCode != code {
+		t.Fatalf("%s: expected *Error with code %d, got %v", what, code, err)
+	}
+}
+
+func clientRead(t *testing.T, client *Client, reqPath string, offset, length int64) (*Item, string) {
+	t.Helper()
+
+	item, data, err := client.Read(reqPath, offset, length)
+	if err != nil {
+		t.Fatalf("Read %s: %v", reqPath, err)
+	}
+	defer data.Close()
+
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return item, string(buf)
+}
+
+func TestClientWriteAndRead(t *testing.T) {
+
+	client, _ := newTestClient(t)
+
+	err := client.Write("/a.txt", strings.NewReader("hello"), 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Write("/a.txt", strings.NewReader("again"), 5, nil)
+	expectErrorCode(t, "Write existing without overwrite", err, 409)
+
+	err = client.Write("/a.txt", strings.NewReader("hello world"), -1, &WriteOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, content := clientRead(t, client, "/a.txt", 0, 0)
+	if content != "hello world" || item.Size != 11 {
+		t.Fatalf("Read: got %q with size %d", content, item.Size)
+	}
+
+	item, content = clientRead(t, client, "/a.txt", 6, 3)
+	if content != "wor" || item.Size != 11 {
+		t.Fatalf("Ranged read: got %q with size %d", content, item.Size)
+	}
+
+	_, content = clientRead(t, client, "/a.txt", 6, 0)
+	if content != "world" {
+		t.Fatalf("Read to end: got %q", content)
+	}
+
+	err = client.Patch("/a.txt", strings.NewReader("_"), 5, 1, nil)
+	expectErrorCode(t, "Patch existing without overwrite", err, 409)
+
+	err = client.Patch("/a.txt", strings.NewReader("_"), 5, 1, &WriteOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, content = clientRead(t, client, "/a.txt", 0, 0)
+	if content != "hello_world" {
+		t.Fatalf("Read after Patch: got %q", content)
+	}
+
+	_, _, err = client.Read("/missing.txt", 0, 0)
+	expectErrorCode(t, "Read missing", err, 404)
+}
+
+func TestClientDirectories(t *testing.T) {
+
+	client, _ := newTestClient(t)
+
+	err := client.MakeDir("/dir/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectErrorCode(t, "MakeDir missing parent", client.MakeDir("/dir/a/b/", false), 404)
+
+	err = client.MakeDir("/dir/a/b/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Write("/dir/a/b/c.txt", strings.NewReader("ccc"), 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := client.List("/dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := item.Children["a/"]; a == nil || a.Children != nil {
+		t.Fatalf("List: got %+v", item.Children)
+	}
+
+	item, err = client.Tree("/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := item.Children["dir/"].Children["a/"].Children["b/"].Children["c.txt"]; c == nil || c.Size != 3 {
+		t.Fatalf("Tree: missing dir/a/b/c.txt")
+	}
+
+	item, err = client.Tree("/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := item.Children["dir/"].Children["a/"]; a == nil || a.Children != nil {
+		t.Fatal("Tree depth 2: wrong depth")
+	}
+
+	expectErrorCode(t, "Delete non-empty", client.Delete("/dir/", false), 409)
+
+	err = client.Delete("/dir/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.List("/dir/")
+	expectErrorCode(t, "List after Delete", err, 404)
+}
+
+func TestClientSetAttributes(t *testing.T) {
+
+	client, _ := newTestClient(t)
+
+	err := client.Write("/run.sh", strings.NewReader("#!/bin/sh\n"), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	err = client.SetAttributes("/run.sh", modTime, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, _ := clientRead(t, client, "/run.sh", 0, 0)
+	if !item.IsExecutable || item.ModTime != "2001-02-03T04:05:06Z" {
+		t.Fatalf("Read after SetAttributes: got %+v", item)
+	}
+
+	err = client.SetAttributes("/missing.txt", modTime, false)
+	expectErrorCode(t, "SetAttributes missing", err, 404)
+}
+
+func TestClientCreateKey(t *testing.T) {
+
+	client, baseUrl := newTestClient(t)
+
+	err := client.MakeDir("/pub/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/pub/a.txt", "/private.txt"} {
+		err = client.Write(p, strings.NewReader("x"), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readKey, err := client.CreateKey(&KeyData{
+		Privileges: map[string]string{
+			"/pub/": "read",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readClient, err := NewClient(baseUrl, readKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, content := clientRead(t, readClient, "/pub/a.txt", 0, 0)
+	if content != "x" {
+		t.Fatalf("Read with new key: got %q", content)
+	}
+
+	_, _, err = readClient.Read("/private.txt", 0, 0)
+	expectErrorCode(t, "Read outside privileges", err, 403)
+
+	err = readClient.Write("/pub/b.txt", strings.NewReader("x"), 1, nil)
+	expectErrorCode(t, "Write with read key", err, 403)
+
+	_, err = readClient.CreateKey(&KeyData{
+		Privileges: map[string]string{
+			"/": "read",
+		},
+	})
+	if _, ok := err.(*Error); !ok {
+		t.Fatalf("CreateKey with more privileges: expected *Error, got %v", err)
+	}
+}
+
+func TestClientReadFrom(t *testing.T) {
+
+	client, _ := newTestClient(t)
+
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	err := client.Write("/a.txt", strings.NewReader("hello world"), 11, &WriteOptions{ModTime: modTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readFrom := func(offset int64, ifRange string) (int64, string, string) {
+		t.Helper()
+
+		_, data, start, validator, err := client.ReadFrom("/a.txt", offset, ifRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer data.Close()
+
+		buf, err := ioutil.ReadAll(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return start, string(buf), validator
+	}
+
+	start, content, validator := readFrom(0, "")
+	if start != 0 || content != "hello world" || validator == "" {
+		t.Fatalf("ReadFrom start: got %d %q %q", start, content, validator)
+	}
+
+	start, content, _ = readFrom(6, validator)
+	if start != 6 || content != "world" {
+		t.Fatalf("ReadFrom unchanged: got %d %q", start, content)
+	}
+
+	err = client.Write("/a.txt", strings.NewReader("HELLO WORLD"), 11, &WriteOptions{
+		Overwrite: true,
+		ModTime:   modTime.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, content, _ = readFrom(6, validator)
+	if start != 0 || content != "HELLO WORLD" {
+		t.Fatalf("ReadFrom changed: got %d %q", start, content)
+	}
+}
+
+func TestClientSign(t *testing.T) {
+
+	client, baseUrl := newTestClient(t)
+
+	err := client.Write("/a.txt", strings.NewReader("hello"), 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedUrl, err := client.Sign(&SignRequest{
+		Path:   "/a.txt",
+		Method: "GET",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(signedUrl, baseUrl+"/a.txt?") {
+		t.Fatalf("Sign: got %s", signedUrl)
+	}
+
+	status, body := doRequest(t, "GET", signedUrl, "", "")
+	if status != 200 || body != "hello" {
+		t.Fatalf("Reading with signed URL: got %d %q", status, body)
+	}
+}
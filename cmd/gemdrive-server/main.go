@@ -17,9 +17,13 @@ func main() {
 	port := flag.Int("port", 3838, "Port")
 	var dirs arrayFlags
 	flag.Var(&dirs, "dir", "Directory to add")
+	var memoryDirs arrayFlags
+	flag.Var(&memoryDirs, "memory-dir", "Name of an in-memory scratch directory to add")
+	memoryDirMaxSize := flag.Int64("memory-dir-max-size", 0, "Most bytes each in-memory directory can hold (0 for no limit)")
 	configPath := flag.String("config", "", "Config path")
 	runDir := flag.String("run-dir", "", "Database directory")
 	rclone := flag.String("rclone", "", "Enable rclone proxy")
+	dbStore := flag.String("db-store", "", "Key database storage: json (default) or bolt")
 	flag.Parse()
 
 	config := &gemdrive.Config{
@@ -47,6 +51,42 @@ func main() {
 		config.Dirs = append(config.Dirs, dir)
 	}
 
+	for _, name := range memoryDirs {
+		config.MemoryDirs = append(config.MemoryDirs, name)
+	}
+
+	if *memoryDirMaxSize != 0 {
+		config.MemoryDirMaxSize = *memoryDirMaxSize
+	}
+
+	if *dbStore != "" {
+		config.DbStore = *dbStore
+	}
+
+	// The master key is only shown when it's created, since just a hash of
+	// it is stored. If it's lost, a new one can be generated. Keys created
+	// with the old one keep working. Stop the server before running this.
+	if flag.Arg(0) == "rotate-master-key" {
+		store, err := gemdrive.OpenStore(config.DataDir, config.DbStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		db, err := gemdrive.NewGemDriveDatabase(store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+
+		masterKey, err := db.RotateMasterKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("Master key: " + masterKey)
+		return
+	}
+
 	tmess := treemess.NewTreeMess()
 	gdTmess := tmess.Branch()
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Profiles hold the server and key to use, so they don't have to be given
+// on every command. The file is only readable by the user since it holds
+// keys.
+type cliConfig struct {
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+type profile struct {
+	Server string `json:"server"`
+	Key    string `json:"key,omitempty"`
+}
+
+func defaultConfigPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "gemdrive_cli.json"
+	}
+	return filepath.Join(configDir, "gemdrive", "cli.json")
+}
+
+func loadConfig(path string) (*cliConfig, error) {
+
+	config := &cliConfig{}
+
+	configBytes, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(configBytes, config)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]*profile)
+	}
+
+	return config, nil
+}
+
+func saveConfig(config *cliConfig, path string) error {
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	configBytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, configBytes, 0600)
+}
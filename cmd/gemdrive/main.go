@@ -0,0 +1,551 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gemdrive "github.com/gemdrive/gemdrive-go"
+)
+
+const usageText = `Usage: gemdrive [options] <command> [arguments]
+
+Commands:
+  config SERVER_URL [KEY]          Save the server and key for the profile
+  ls [-l] [PATH]                   List a directory
+  tree [-depth N] [PATH]           List a directory and everything under it
+  get [-c] PATH [LOCAL_PATH]       Download a file, -c continues a partial download.
+                                   A LOCAL_PATH of - writes to stdout
+  put [-f] LOCAL_PATH PATH         Upload a file, keeping its mod time and executable bit
+  rm [-r] PATH...                  Delete files, or directories with -r
+  mkdir [-p] PATH...               Create directories, and their parents with -p
+  mv [-f] SRC_PATH DST_PATH        Move or rename
+  create-key [-expires T] [-max-uses N] PATH=PERMS...
+                                   Create a key, e.g. /photos/=read
+  share [-expires T] PATH          Create a read-only link to a file, signed with the key
+  remote-get [-f] URL PATH         Have the server download a URL
+
+Expiry times are durations like 24h or RFC3339 timestamps.
+
+Options:
+`
+
+func main() {
+
+	configPath := flag.String("config", defaultConfigPath(), "Config path")
+	profileName := flag.String("profile", "default", "Config profile")
+	serverUrl := flag.String("server", "", "Server URL, instead of the profile's")
+	key := flag.String("key", "", "Key, instead of the profile's")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usageText)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command := flag.Arg(0)
+	args := flag.Args()[1:]
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		exit(err)
+	}
+
+	if command == "config" {
+		err := setProfile(config, *configPath, *profileName, args)
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	prof := &profile{}
+	if p, exists := config.Profiles[*profileName]; exists {
+		prof = p
+	}
+
+	if *serverUrl != "" {
+		prof.Server = *serverUrl
+	}
+	if *key != "" {
+		prof.Key = *key
+	}
+
+	if prof.Server == "" {
+		exit(errors.New("No server set. Use the config command or -server"))
+	}
+
+	client, err := gemdrive.NewClient(prof.Server, prof.Key)
+	if err != nil {
+		exit(err)
+	}
+
+	switch command {
+	case "ls":
+		err = ls(client, args)
+	case "tree":
+		err = tree(client, args)
+	case "get":
+		err = get(client, args)
+	case "put":
+		err = put(client, args)
+	case "rm":
+		err = rm(client, args)
+	case "mkdir":
+		err = mkdir(client, args)
+	case "mv":
+		err = mv(client, args)
+	case "create-key":
+		err = createKey(client, args)
+	case "share":
+		err = share(client, args)
+	case "remote-get":
+		err = remoteGet(client, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		exit(err)
+	}
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, "gemdrive:", err)
+	os.Exit(1)
+}
+
+// Paths on the server are always absolute.
+func remotePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return "/" + p
+	}
+	return p
+}
+
+func setProfile(config *cliConfig, configPath, profileName string, args []string) error {
+
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: config SERVER_URL [KEY]")
+	}
+
+	prof := &profile{
+		Server: args[0],
+	}
+	if len(args) == 2 {
+		prof.Key = args[1]
+	}
+
+	_, err := gemdrive.NewClient(prof.Server, prof.Key)
+	if err != nil {
+		return err
+	}
+
+	config.Profiles[profileName] = prof
+
+	return saveConfig(config, configPath)
+}
+
+func ls(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	long := flags.Bool("l", false, "Show size, mod time and whether files are executable")
+	flags.Parse(args)
+
+	dir := "/"
+	if flags.NArg() > 0 {
+		dir = remotePath(flags.Arg(0))
+	}
+
+	item, err := client.List(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sortedNames(item) {
+		if *long {
+			child := item.Children[name]
+			mode := "-"
+			if child.IsExecutable {
+				mode = "x"
+			}
+			fmt.Printf("%s %12d %s %s\n", mode, child.Size, child.ModTime, name)
+		} else {
+			fmt.Println(name)
+		}
+	}
+
+	return nil
+}
+
+func tree(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("tree", flag.ExitOnError)
+	depth := flags.Int("depth", 0, "How many levels to list, 0 for all")
+	flags.Parse(args)
+
+	dir := "/"
+	if flags.NArg() > 0 {
+		dir = remotePath(flags.Arg(0))
+	}
+
+	item, err := client.Tree(dir, *depth)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(dir)
+	printTree(item, "  ")
+
+	return nil
+}
+
+func printTree(item *gemdrive.Item, indent string) {
+	for _, name := range sortedNames(item) {
+		fmt.Println(indent + name)
+		printTree(item.Children[name], indent+"  ")
+	}
+}
+
+func sortedNames(item *gemdrive.Item) []string {
+	names := []string{}
+	for name := range item.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func get(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	resume := flags.Bool("c", false, "Continue a partial download")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("Usage: get [-c] PATH [LOCAL_PATH]")
+	}
+
+	srcPath := remotePath(flags.Arg(0))
+
+	dstPath := path.Base(srcPath)
+	if flags.NArg() == 2 {
+		dstPath = flags.Arg(1)
+		if stat, err := os.Stat(dstPath); err == nil && stat.IsDir() {
+			dstPath = filepath.Join(dstPath, path.Base(srcPath))
+		}
+	}
+
+	if dstPath == "-" {
+		_, data, err := client.Read(srcPath, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+
+		_, err = io.Copy(os.Stdout, data)
+		return err
+	}
+
+	// What the file was when the download started is kept next to it
+	// until it's done, so it's only continued if the file hasn't changed.
+	validatorPath := dstPath + ".gemdrive-partial"
+
+	var offset int64
+	var ifRange string
+
+	if *resume {
+		stat, err := os.Stat(dstPath)
+		if err == nil {
+			offset = stat.Size()
+
+			validator, err := ioutil.ReadFile(validatorPath)
+			if err == nil {
+				ifRange = strings.TrimSpace(string(validator))
+			} else {
+				// Finished downloads get the mod time of the original
+				ifRange = stat.ModTime().UTC().Format(http.TimeFormat)
+			}
+		}
+	}
+
+	item, data, start, validator, err := client.ReadFrom(srcPath, offset, ifRange)
+	if e, ok := err.(*gemdrive.Error); ok && e.HttpCode == 416 && offset > 0 {
+		return fmt.Errorf("%s is bigger than %s, can't continue", dstPath, srcPath)
+	} else if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	mask := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if start > 0 {
+		mask = os.O_WRONLY | os.O_APPEND
+	} else if offset > 0 {
+		fmt.Fprintf(os.Stderr, "%s has changed, downloading all of it again\n", srcPath)
+	}
+
+	if validator != "" {
+		err = ioutil.WriteFile(validatorPath, []byte(validator), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(dstPath, mask, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(validatorPath)
+
+	if item.IsExecutable {
+		stat, err := os.Stat(dstPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chmod(dstPath, stat.Mode().Perm()|0111)
+		if err != nil {
+			return err
+		}
+	}
+
+	modTime, err := time.Parse(time.RFC3339, item.ModTime)
+	if err == nil {
+		return os.Chtimes(dstPath, modTime, modTime)
+	}
+
+	return nil
+}
+
+func put(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	overwrite := flags.Bool("f", false, "Overwrite an existing file")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("Usage: put [-f] LOCAL_PATH PATH")
+	}
+
+	srcPath := flags.Arg(0)
+
+	dstPath := remotePath(flags.Arg(1))
+	if strings.HasSuffix(dstPath, "/") {
+		dstPath += filepath.Base(srcPath)
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.IsDir() {
+		return fmt.Errorf("%s is a directory", srcPath)
+	}
+
+	return client.Write(dstPath, file, stat.Size(), &gemdrive.WriteOptions{
+		Overwrite:    *overwrite,
+		ModTime:      stat.ModTime(),
+		IsExecutable: gemdrive.IsExecutable(stat),
+	})
+}
+
+func rm(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	recursive := flags.Bool("r", false, "Delete directories and everything in them")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("Usage: rm [-r] PATH...")
+	}
+
+	for _, p := range flags.Args() {
+		err := client.Delete(remotePath(p), *recursive)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+func mkdir(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("mkdir", flag.ExitOnError)
+	parents := flags.Bool("p", false, "Create parent directories as needed")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("Usage: mkdir [-p] PATH...")
+	}
+
+	for _, p := range flags.Args() {
+		err := client.MakeDir(remotePath(p), *parents)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+func mv(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("mv", flag.ExitOnError)
+	overwrite := flags.Bool("f", false, "Replace the destination if it exists")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("Usage: mv [-f] SRC_PATH DST_PATH")
+	}
+
+	return client.Move(remotePath(flags.Arg(0)), remotePath(flags.Arg(1)), *overwrite)
+}
+
+func createKey(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("create-key", flag.ExitOnError)
+	expires := flags.String("expires", "", "When the key expires")
+	maxUses := flags.Int("max-uses", 0, "How many times the key can be used, 0 for no limit")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("Usage: create-key [-expires T] [-max-uses N] PATH=PERMS...")
+	}
+
+	keyData := &gemdrive.KeyData{
+		Privileges: make(map[string]string),
+		MaxUses:    *maxUses,
+	}
+
+	for _, arg := range flags.Args() {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid privilege %s, expected PATH=PERMS", arg)
+		}
+		keyData.Privileges[remotePath(parts[0])] = parts[1]
+	}
+
+	expiresAt, err := parseExpiry(*expires)
+	if err != nil {
+		return err
+	}
+	keyData.ExpiresAt = expiresAt
+
+	newKey, err := client.CreateKey(keyData)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(newKey)
+
+	return nil
+}
+
+func share(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("share", flag.ExitOnError)
+	expires := flags.String("expires", "24h", "When the link expires, empty for the server's default of an hour")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("Usage: share [-expires T] PATH")
+	}
+
+	sharePath := remotePath(flags.Arg(0))
+
+	// Signed URLs are good for a single path
+	if strings.HasSuffix(sharePath, "/") {
+		return errors.New("Only files can be shared. Use create-key to share a directory")
+	}
+
+	expiresAt, err := parseExpiry(*expires)
+	if err != nil {
+		return err
+	}
+
+	shareUrl, err := client.Sign(&gemdrive.SignRequest{
+		Path:      sharePath,
+		Method:    "GET",
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(shareUrl)
+
+	return nil
+}
+
+func remoteGet(client *gemdrive.Client, args []string) error {
+
+	flags := flag.NewFlagSet("remote-get", flag.ExitOnError)
+	overwrite := flags.Bool("f", false, "Replace the destination if it exists")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("Usage: remote-get [-f] URL PATH")
+	}
+
+	return client.RemoteGet(&gemdrive.RemoteGetRequest{
+		Source:      flags.Arg(0),
+		Destination: remotePath(flags.Arg(1)),
+		Overwrite:   *overwrite,
+		Truncate:    true,
+	})
+}
+
+// parseExpiry accepts either a duration from now or an RFC3339 timestamp,
+// and returns the latter.
+func parseExpiry(expiry string) (string, error) {
+
+	if expiry == "" {
+		return "", nil
+	}
+
+	duration, err := time.ParseDuration(expiry)
+	if err == nil {
+		return time.Now().Add(duration).UTC().Format(time.RFC3339), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return "", fmt.Errorf("Invalid expiry %s", expiry)
+	}
+
+	return t.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,183 @@
+package gemdrive
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// itemETag returns a strong ETag based on the file's SHA-256 if the backend
+// already has it, otherwise a weak one based on size and mod time. Files
+// are never hashed just to get an ETag, since that means reading all of
+// them before sending a byte. Hashes get cached when they're asked for
+// with the hash parameter of list.json and tree.json. The mod time goes in
+// with as much precision as the backend has, so that writes within the same
+// second still change the ETag.
+func (s *Server) itemETag(reqPath string, item *Item) string {
+
+	if hasher, ok := s.backend.(CachedHasher); ok {
+		hash, ok := hasher.GetCachedHash(reqPath, HashSha256)
+		if ok {
+			return `"` + hash + `"`
+		}
+	}
+
+	return fmt.Sprintf(`W/"%x-%x"`, item.Size, parseModTime(item.ModTime).UnixNano())
+}
+
+// setValidatorHeaders sets the ETag, along with an RFC 3230 Digest header
+// when the ETag is a hash.
+func (s *Server) setValidatorHeaders(w http.ResponseWriter, reqPath string, item *Item) {
+
+	header := w.Header()
+
+	etag := s.itemETag(reqPath, item)
+	header.Set("ETag", etag)
+
+	if strings.HasPrefix(etag, "W/") {
+		return
+	}
+
+	hashBytes, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil {
+		return
+	}
+
+	header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(hashBytes))
+}
+
+// checkPreconditions evaluates the conditional request headers as described
+// in RFC 7232 section 6. If it returns false a 304 or 412 response has
+// already been sent.
+func (s *Server) checkPreconditions(w http.ResponseWriter, r *http.Request, reqPath string) bool {
+
+	ifMatch := r.Header.Get("If-Match")
+	ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+
+	if ifMatch == "" && ifUnmodifiedSince == "" && ifNoneMatch == "" && ifModifiedSince == "" {
+		return true
+	}
+
+	isRead := r.Method == "GET" || r.Method == "HEAD"
+
+	item, isDir, err := statItem(s.backend, reqPath)
+	exists := err == nil && !isDir
+
+	// Looking up the ETag means going to the backend, so only do it if
+	// needed.
+	etag := ""
+	getETag := func() string {
+		if etag == "" {
+			etag = s.itemETag(reqPath, item)
+		}
+		return etag
+	}
+
+	if ifMatch != "" {
+		if !exists || !etagListMatches(ifMatch, getETag, false) {
+			sendPreconditionFailed(w)
+			return false
+		}
+	} else if ifUnmodifiedSince != "" && exists {
+		t, err := http.ParseTime(ifUnmodifiedSince)
+		if err == nil && modTimeAfter(item, t) {
+			sendPreconditionFailed(w)
+			return false
+		}
+	}
+
+	if ifNoneMatch != "" {
+		if exists && etagListMatches(ifNoneMatch, getETag, true) {
+			if isRead {
+				s.sendNotModified(w, reqPath, item)
+			} else {
+				sendPreconditionFailed(w)
+			}
+			return false
+		}
+	} else if ifModifiedSince != "" && isRead && exists {
+		t, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !modTimeAfter(item, t) {
+			s.sendNotModified(w, reqPath, item)
+			return false
+		}
+	}
+
+	return true
+}
+
+// ifRangeMatches reports whether a Range header should be honored given the
+// If-Range header, which may contain either an ETag or a date.
+func (s *Server) ifRangeMatches(r *http.Request, reqPath string, item *Item) bool {
+
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// Weak ETags can't be used with If-Range
+		etag := s.itemETag(reqPath, item)
+		return !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+
+	return parseModTime(item.ModTime).Unix() == t.Unix()
+}
+
+// Without weak, ETags have to match exactly. Files whose hash isn't cached
+// only have weak ETags, and RFC 7232 would have If-Match fail for those
+// every time, making conditional writes to them impossible. Instead a weak
+// ETag matches if it's the one the file has now, which still catches any
+// change to its size or mod time.
+func etagListMatches(header string, getETag func() string, weak bool) bool {
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	etag := getETag()
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HTTP dates only have second precision
+func modTimeAfter(item *Item, t time.Time) bool {
+	return parseModTime(item.ModTime).Unix() > t.Unix()
+}
+
+func (s *Server) sendNotModified(w http.ResponseWriter, reqPath string, item *Item) {
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Set("Last-Modified", parseModTime(item.ModTime).UTC().Format(http.TimeFormat))
+	s.setValidatorHeaders(w, reqPath, item)
+	w.WriteHeader(304)
+}
+
+func sendPreconditionFailed(w http.ResponseWriter) {
+	w.Header().Del("Content-Type")
+	w.WriteHeader(412)
+	io.WriteString(w, "Precondition failed")
+}
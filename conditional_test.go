@@ -0,0 +1,116 @@
+package gemdrive
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getWithHeaders(t *testing.T, reqUrl, key string) *http.Response {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", reqUrl, nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func TestETagsOnlyUseCachedHashes(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "hello")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	res := getWithHeaders(t, baseUrl+"/a.txt", masterKey)
+	weakETag := res.Header.Get("ETag")
+	if !strings.HasPrefix(weakETag, "W/") || res.Header.Get("Digest") != "" {
+		t.Fatalf("Got ETag %q and Digest %q before the hash was asked for", weakETag, res.Header.Get("Digest"))
+	}
+
+	status, body := doRequest(t, "GET", baseUrl+"/gemdrive/index/list.json?hash=sha256", masterKey, "")
+	if status != 200 || !strings.Contains(body, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824") {
+		t.Fatalf("Listing with hashes: %d %s", status, body)
+	}
+
+	res = getWithHeaders(t, baseUrl+"/a.txt", masterKey)
+	if res.Header.Get("ETag") != `"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"` {
+		t.Fatalf("Got ETag %q once the hash was cached", res.Header.Get("ETag"))
+	}
+	if res.Header.Get("Digest") == "" {
+		t.Fatal("No Digest once the hash was cached")
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+"/gemdrive/index/list.json?hash=blake3", masterKey, "")
+	if status != 400 {
+		t.Fatalf("Unsupported hash algorithm: got %d, want 400", status)
+	}
+}
+
+func TestIfMatchWithWeakETag(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "hello")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	etag := getWithHeaders(t, baseUrl+"/a.txt", masterKey).Header.Get("ETag")
+
+	put := func(ifMatch string) int {
+		req, _ := http.NewRequest("PUT", baseUrl+"/a.txt?overwrite=true", strings.NewReader("changed"))
+		req.Header.Set("Authorization", "Bearer "+masterKey)
+		req.Header.Set("If-Match", ifMatch)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if status := put(`W/"0-0"`); status != 412 {
+		t.Fatalf("Stale ETag: got %d, want 412", status)
+	}
+
+	if status := put(etag); status != 200 {
+		t.Fatalf("Current ETag: got %d, want 200", status)
+	}
+}
+
+func TestWeakETagChangesWithinASecond(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "hello")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	etag := getWithHeaders(t, baseUrl+"/a.txt", masterKey).Header.Get("ETag")
+
+	// Enough for the file system's timestamps to tick over
+	time.Sleep(50 * time.Millisecond)
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/a.txt?overwrite=true", masterKey, "HELLO")
+	if status != 200 {
+		t.Fatalf("Overwriting file: %d", status)
+	}
+
+	newETag := getWithHeaders(t, baseUrl+"/a.txt", masterKey).Header.Get("ETag")
+	if newETag == etag {
+		t.Fatalf("ETag %s didn't change after a write of the same size", etag)
+	}
+}
@@ -0,0 +1,256 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+	key, _ := extractToken(r)
+
+	if key == "" {
+		key = "public"
+	}
+
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	reqData := &CopyRequest{}
+	err = json.Unmarshal(bodyJson, reqData)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if reqData.Source == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "copy: Missing source")
+		return
+	}
+
+	if reqData.Destination == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "copy: Missing destination")
+		return
+	}
+
+	// Unlike URL paths, these haven't been cleaned
+	if !isCanonicalPath(reqData.Source) || !isCanonicalPath(reqData.Destination) {
+		w.WriteHeader(400)
+		io.WriteString(w, "copy: Invalid path")
+		return
+	}
+
+	srcPath := mappedRoot + reqData.Source
+	dstPath := mappedRoot + reqData.Destination
+
+	srcPerm := "read"
+	if _, isDir, err := statItem(s.backend, srcPath); err == nil && isDir {
+		srcPerm = "list,read"
+	}
+
+	if !s.keyAuth.CanRecursive(key, srcPath, srcPerm) {
+		w.WriteHeader(403)
+		io.WriteString(w, "copy: You don't have permission to read from "+reqData.Source)
+		return
+	}
+
+	dstPerm := writePerm(s.writeEventType(dstPath, reqData.Overwrite))
+
+	if !s.keyAuth.CanRecursive(key, dstPath, dstPerm) {
+		w.WriteHeader(403)
+		io.WriteString(w, "copy: You don't have permission to write to "+reqData.Destination)
+		return
+	}
+
+	if _, ok := s.backend.(WritableBackend); !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "copy: Backend does not support writing")
+		return
+	}
+
+	err = copyItem(s.backend, srcPath, dstPath, reqData.Overwrite)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, "copy: "+e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, "copy: "+err.Error())
+		return
+	}
+
+	s.emit("create", dstPath)
+}
+
+// copyItem copies within a single backend, letting the backend do it if it
+// implements Copier.
+func copyItem(backend Backend, srcPath, dstPath string, overwrite bool) error {
+	if copier, ok := backend.(Copier); ok {
+		return copier.Copy(srcPath, dstPath, overwrite)
+	}
+
+	if isInside(dstPath, srcPath) {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Can't copy a directory into itself",
+		}
+	}
+
+	return transferItem(backend, srcPath, backend, dstPath, overwrite, false)
+}
+
+// moveItem moves within a single backend, letting the backend do it if it
+// implements Mover.
+func moveItem(backend Backend, srcPath, dstPath string, overwrite bool) error {
+	if mover, ok := backend.(Mover); ok {
+		return mover.Move(srcPath, dstPath, overwrite)
+	}
+
+	if isInside(dstPath, srcPath) {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Can't move a directory into itself",
+		}
+	}
+
+	return transferItem(backend, srcPath, backend, dstPath, overwrite, true)
+}
+
+// Reports whether p is dir or somewhere below it.
+func isInside(p, dir string) bool {
+	p = strings.TrimSuffix(p, "/")
+	dir = strings.TrimSuffix(dir, "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// transferItem copies an item with copyTree, replacing the destination if
+// overwrite is set, and for moves deletes the source afterwards. It's the
+// fallback for backends that aren't a Copier or Mover, and for transfers
+// between backends.
+func transferItem(src Backend, srcPath string, dst Backend, dstPath string, overwrite, move bool) error {
+
+	dstWritable, ok := dst.(WritableBackend)
+	if !ok {
+		return &Error{
+			HttpCode: 500,
+			Message:  "Backend does not support writing",
+		}
+	}
+
+	srcWritable, srcIsWritable := src.(WritableBackend)
+
+	if move && !srcIsWritable {
+		return &Error{
+			HttpCode: 500,
+			Message:  "Backend does not support writing",
+		}
+	}
+
+	_, srcIsDir, err := statItem(src, srcPath)
+	if err != nil {
+		return err
+	}
+
+	_, dstIsDir, err := statItem(dst, dstPath)
+	if err == nil {
+		if !overwrite {
+			return &Error{
+				HttpCode: 409,
+				Message:  "Destination exists",
+			}
+		}
+
+		if dstIsDir {
+			dstPath = dirPath(dstPath)
+		}
+
+		err := dstWritable.Delete(dstPath, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = copyTree(src, srcPath, dstWritable, dstPath)
+	if err != nil {
+		return err
+	}
+
+	if !move {
+		return nil
+	}
+
+	if srcIsDir {
+		srcPath = dirPath(srcPath)
+	}
+
+	return srcWritable.Delete(srcPath, true)
+}
+
+// copyTree recursively copies a file or directory using only the generic
+// Backend and WritableBackend methods, so it works between any two
+// backends. Mod times and the executable bit are preserved.
+func copyTree(src Backend, srcPath string, dst WritableBackend, dstPath string) error {
+
+	item, isDir, err := statItem(src, srcPath)
+	if err != nil {
+		return err
+	}
+
+	modTime, timeErr := time.Parse(time.RFC3339, item.ModTime)
+
+	if isDir {
+		err := dst.MakeDir(dirPath(dstPath), false)
+		if err != nil {
+			return err
+		}
+
+		listing, err := src.List(dirPath(srcPath), 1)
+		if err != nil {
+			return err
+		}
+
+		for childName := range listing.Children {
+			childName = strings.TrimSuffix(childName, "/")
+			err := copyTree(src, path.Join(srcPath, childName), dst, path.Join(dstPath, childName))
+			if err != nil {
+				return err
+			}
+		}
+
+		// Set after the children are written, since that changes the
+		// directory's mod time.
+		if timeErr == nil {
+			return dst.SetAttributes(dirPath(dstPath), modTime, item.IsExecutable)
+		}
+
+		return nil
+	}
+
+	_, data, err := src.Read(srcPath, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	err = dst.Write(dstPath, data, 0, item.Size, false, true)
+	if err != nil {
+		return err
+	}
+
+	if timeErr != nil {
+		return nil
+	}
+
+	return dst.SetAttributes(dstPath, modTime, item.IsExecutable)
+}
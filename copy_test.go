@@ -0,0 +1,98 @@
+package gemdrive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCopyRejectsTraversal(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	client, err := NewClient(baseUrl, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.MakeDir("/docs/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Write("/secret.txt", strings.NewReader("secret"), 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docsKey, err := client.CreateKey(&KeyData{
+		Privileges: map[string]string{
+			"/docs/": "write",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"source": "/docs/../secret.txt", "destination": "/docs/stolen.txt"}`,
+		`{"source": "/docs/", "destination": "/docs/../../outside/"}`,
+		`{"source": "docs/a.txt", "destination": "/docs/b.txt"}`,
+	} {
+		status, _ := doRequest(t, "POST", baseUrl+"/gemdrive/copy", docsKey, body)
+		if status != 400 {
+			t.Errorf("%s: got %d, want 400", body, status)
+		}
+	}
+
+	status, _ := doRequest(t, "GET", baseUrl+"/docs/stolen.txt", masterKey, "")
+	if status != 404 {
+		t.Fatalf("Copied file: got %d, want 404", status)
+	}
+}
+
+// Hides the memory backend's Copy and Move, to exercise the fallbacks.
+type plainBackend struct {
+	Backend
+	WritableBackend
+}
+
+func TestCopyAndMoveFallback(t *testing.T) {
+
+	memory := NewMemoryBackend(1024)
+	backend := plainBackend{memory, memory}
+
+	err := backend.MakeDir("/src/sub/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.Write("/src/sub/a.txt", strings.NewReader("a"), 0, 1, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = copyItem(backend, "/src/", "/copy/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectErrorCode(t, "Copy onto existing", copyItem(backend, "/src/", "/copy/", false), 409)
+	expectErrorCode(t, "Copy into itself", copyItem(backend, "/src/", "/src/sub/src/", false), 400)
+
+	err = moveItem(backend, "/copy/", "/moved/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := statItem(backend, "/copy/"); err == nil {
+		t.Fatal("Move left the source behind")
+	}
+
+	_, data, err := backend.Read("/moved/sub/a.txt", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+
+	expectErrorCode(t, "Move missing", moveItem(backend, "/missing/", "/x/", false), 404)
+}
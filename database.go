@@ -1,44 +1,68 @@
 package gemdrive
 
 import (
-	//"fmt"
-	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"path/filepath"
 	"sync"
+	"time"
 )
 
+// Everything is kept in memory, and changes are saved to the store as they
+// happen. KeyData and UserData are never modified in place once stored;
+// changes replace them with updated copies.
 type GemDriveDatabase struct {
-	Keys   map[string]*KeyData `json:"keys"`
-	dbPath string
-	mutex  *sync.Mutex
+	Keys    map[string]*KeyData
+	Users   map[string]*UserData
+	store   Store
+	version int
+	mutex   *sync.Mutex
+	done    chan struct{}
+	// Keys left over from before keys carried their ID. Only these get
+	// checked for tokens without one.
+	bareIds map[string]bool
 }
 
-func NewGemDriveDatabase(dir string) (*GemDriveDatabase, error) {
+// Each user has a key that holds their privileges. Nobody knows the key
+// itself; logging in creates short-lived child keys of it.
+type UserData struct {
+	PasswordHash string `json:"passwordHash"`
+	KeyId        string `json:"keyId"`
+}
 
-	dbPath := filepath.Join(dir, "gemdrive_db.json")
+func NewGemDriveDatabase(store Store) (*GemDriveDatabase, error) {
+
+	data, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
 
 	db := &GemDriveDatabase{
-		Keys:   make(map[string]*KeyData),
-		dbPath: dbPath,
-		mutex:  &sync.Mutex{},
+		Keys:    data.Keys,
+		Users:   data.Users,
+		store:   store,
+		version: data.Version,
+		mutex:   &sync.Mutex{},
+		done:    make(chan struct{}),
+		bareIds: make(map[string]bool),
 	}
 
-	dbJson, err := ioutil.ReadFile(dbPath)
-	if err == nil {
-		err = json.Unmarshal(dbJson, &db)
-		if err != nil {
-			log.Println(err)
+	for id, keyData := range db.Keys {
+		if keyData.Bare {
+			db.bareIds[id] = true
 		}
 	}
 
-	_, err = db.GetMasterKey()
+	err = db.migrate()
 	if err != nil {
-		masterKey, err := genRandomKey()
+		return nil, err
+	}
+
+	_, err = db.GetMasterKeyId()
+	if err != nil {
+		masterKey, err := genKey()
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
 
 		masterKeyData := &KeyData{
@@ -47,74 +71,640 @@ func NewGemDriveDatabase(dir string) (*GemDriveDatabase, error) {
 				"/": "write",
 			},
 		}
-		db.SetKeyData(masterKey, masterKeyData)
+		masterKeyId, err := db.SetKeyData(masterKey, masterKeyData)
+		if err != nil {
+			return nil, err
+		}
 
 		publicKeyData := &KeyData{
-			Parent:     masterKey,
+			Parent:     masterKeyId,
 			Privileges: make(map[string]string),
 		}
-		db.SetKeyData("public", publicKeyData)
+		_, err = db.SetKeyData("public", publicKeyData)
+		if err != nil {
+			return nil, err
+		}
 
-		db.Persist()
+		// Only a hash is stored, so this is the only chance to see it
+		fmt.Println("Master key: " + masterKey)
 	}
 
+	db.PruneExpiredKeys()
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				db.PruneExpiredKeys()
+			case <-db.done:
+				return
+			}
+		}
+	}()
+
 	return db, nil
 }
 
-func (db GemDriveDatabase) Persist() error {
-	saveJson(db, db.dbPath)
+// Each migration brings the stored data from the version before it to the
+// next. The store records how many have run.
+var dbMigrations = []func(db *GemDriveDatabase, changes *StoreChanges) error{
+	migrateKeyIds,
+	migratePrivileges,
+}
+
+func (db *GemDriveDatabase) migrate() error {
+
+	for i := db.version; i < len(dbMigrations); i++ {
+		changes := newStoreChanges()
+
+		err := dbMigrations[i](db, changes)
+		if err != nil {
+			return err
+		}
+
+		changes.Version = i + 1
+
+		err = db.commit(changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Keys used to be stored raw, and then under their first 8 characters, which
+// gave part of the key away everywhere the ID was shown. Every key gets a
+// new random ID. The keys themselves stay the same, which makes them bare.
+func migrateKeyIds(db *GemDriveDatabase, changes *StoreChanges) error {
+
+	if len(db.Keys) == 0 {
+		return nil
+	}
+
+	log.Println("Migrating keys to random key IDs")
+
+	newIds := make(map[string]string)
+	for oldId := range db.Keys {
+		if oldId == "public" {
+			newIds[oldId] = oldId
+			continue
+		}
+
+		id, err := db.newKeyId()
+		if err != nil {
+			return err
+		}
+		newIds[oldId] = id
+	}
+
+	for oldId, oldKeyData := range db.Keys {
+
+		keyData := *oldKeyData
+
+		if keyData.Hash == "" {
+			salt, hash, err := hashKey(oldId)
+			if err != nil {
+				return err
+			}
+
+			keyData.Salt = salt
+			keyData.Hash = hash
+		}
+
+		// Keys whose parent is gone keep pointing nowhere, so they stay
+		// revoked.
+		if parentId, exists := newIds[keyData.Parent]; exists {
+			keyData.Parent = parentId
+		}
+
+		id := newIds[oldId]
+		keyData.Bare = id != oldId
+
+		if id != oldId {
+			changes.DeleteKeys = append(changes.DeleteKeys, oldId)
+		}
+		changes.PutKeys[id] = &keyData
+	}
+
+	for username, oldUserData := range db.Users {
+		if id, exists := newIds[oldUserData.KeyId]; exists {
+			userData := *oldUserData
+			userData.KeyId = id
+			changes.PutUsers[username] = &userData
+		}
+	}
+
+	return nil
+}
+
+// Before there were finer-grained permissions, read also allowed listing
+// directories, and any key could create keys with a subset of its
+// privileges. Now those take list and manage-keys.
+func migratePrivileges(db *GemDriveDatabase, changes *StoreChanges) error {
+
+	for id, oldKeyData := range db.Keys {
+
+		changed := false
+		privileges := make(map[string]string)
+
+		for pattern, perm := range oldKeyData.Privileges {
+			if perm == "read" {
+				perm = "list,read,manage-keys"
+				changed = true
+			}
+			privileges[pattern] = perm
+		}
+
+		if changed {
+			keyData := *oldKeyData
+			keyData.Privileges = privileges
+			changes.PutKeys[id] = &keyData
+		}
+	}
+
+	if len(changes.PutKeys) > 0 {
+		log.Println("Migrating read privileges to list,read,manage-keys")
+	}
+
 	return nil
 }
 
-func (db *GemDriveDatabase) SetKeyData(key string, keyData *KeyData) {
+// newKeyId picks a random key ID that isn't taken. Must be called with the
+// mutex held.
+func (db *GemDriveDatabase) newKeyId() (string, error) {
+	for {
+		id, err := genRandomString(keyIdLength)
+		if err != nil {
+			return "", err
+		}
+
+		if _, exists := db.Keys[id]; !exists {
+			return id, nil
+		}
+	}
+}
+
+// commit saves changes to the store, and only once that has worked applies
+// them in memory. Must be called with the mutex held.
+func (db *GemDriveDatabase) commit(changes *StoreChanges) error {
+
+	if changes.isEmpty() {
+		return nil
+	}
+
+	err := db.store.Commit(changes)
+	if err != nil {
+		return err
+	}
+
+	data := &StoreData{Version: db.version, Keys: db.Keys, Users: db.Users}
+	applyStoreChanges(data, changes)
+	db.version = data.Version
+
+	for _, id := range changes.DeleteKeys {
+		delete(db.bareIds, id)
+	}
+	for id, keyData := range changes.PutKeys {
+		if keyData.Bare {
+			db.bareIds[id] = true
+		} else {
+			delete(db.bareIds, id)
+		}
+	}
+
+	return nil
+}
+
+// Close stops pruning expired keys and closes the underlying store.
+func (db *GemDriveDatabase) Close() error {
+	close(db.done)
+
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	db.Keys[key] = keyData
+	return db.store.Close()
+}
+
+// SetKeyData stores the data for a key under the key's ID and returns the
+// ID. The key itself is only stored as a salted hash. Keys without an ID are
+// only accepted if they're "public" or one of the bare keys left over from
+// before keys had IDs.
+func (db *GemDriveDatabase) SetKeyData(key string, keyData *KeyData) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-	db.Persist()
+	id, hasId := splitKeyId(key)
+	if !hasId {
+		var found bool
+		id, found = db.bareKeyId(key)
+		if !found {
+			return "", errors.New("Keys must be of the form <id>.<secret>")
+		}
+	}
+
+	existing, exists := db.Keys[id]
+	if exists && !existing.matchesKey(key) {
+		return "", errors.New("Key ID already in use")
+	}
+
+	keyData.Bare = !hasId && key != "public"
+
+	salt, hash, err := hashKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	keyData.Salt = salt
+	keyData.Hash = hash
+
+	changes := newStoreChanges()
+	changes.PutKeys[id] = keyData
+
+	err = db.commit(changes)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
 }
 
-func (db *GemDriveDatabase) DeleteKeyData(key string) error {
+func (db *GemDriveDatabase) DeleteKeyData(id string) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	_, exists := db.Keys[key]
+	_, exists := db.Keys[id]
 
 	if !exists {
 		return errors.New("No such key")
 	}
 
-	delete(db.Keys, key)
+	changes := newStoreChanges()
+	changes.DeleteKeys = []string{id}
 
-	db.Persist()
+	return db.commit(changes)
+}
 
-	return nil
+// RotateMasterKey replaces the master key with a new random one and returns
+// it. Keys created by the old master key are moved over to the new one.
+func (db *GemDriveDatabase) RotateMasterKey() (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	oldId, err := db.masterKeyId()
+	if err != nil {
+		return "", err
+	}
+
+	var newKey, newId string
+	for {
+		newKey, err = genKey()
+		if err != nil {
+			return "", err
+		}
+
+		newId, _ = splitKeyId(newKey)
+		if _, exists := db.Keys[newId]; !exists {
+			break
+		}
+	}
+
+	keyData := *db.Keys[oldId]
+	keyData.Bare = false
+
+	keyData.Salt, keyData.Hash, err = hashKey(newKey)
+	if err != nil {
+		return "", err
+	}
+
+	changes := newStoreChanges()
+	changes.DeleteKeys = []string{oldId}
+	changes.PutKeys[newId] = &keyData
+
+	for id, child := range db.Keys {
+		if child.Parent == oldId {
+			updated := *child
+			updated.Parent = newId
+			changes.PutKeys[id] = &updated
+		}
+	}
+
+	err = db.commit(changes)
+	if err != nil {
+		return "", err
+	}
+
+	return newKey, nil
+}
+
+// UseKey counts a use of a key with a usage limit, and reports whether it
+// had one left. Checking and counting happen together, so concurrent
+// requests can't go over the limit between them. Keys without a limit are
+// left alone to avoid writing the database on every request. Unknown keys
+// have nothing to count, and are left for the caller to reject.
+func (db *GemDriveDatabase) UseKey(key string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id, _, err := db.lookupKey(key)
+	if err != nil {
+		return true
+	}
+
+	return db.useKeyId(id)
+}
+
+// UseKeyId is UseKey for a key that's already been checked.
+func (db *GemDriveDatabase) UseKeyId(id string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.useKeyId(id)
+}
+
+func (db *GemDriveDatabase) useKeyId(id string) bool {
+
+	keyData, exists := db.Keys[id]
+	if !exists || keyData.MaxUses == 0 {
+		return true
+	}
+
+	if keyData.isUsedUp() {
+		return false
+	}
+
+	// Copy rather than modify in place, since callers may be holding on
+	// to the old one.
+	updated := *keyData
+	updated.Uses++
+
+	changes := newStoreChanges()
+	changes.PutKeys[id] = &updated
+
+	err := db.commit(changes)
+	if err != nil {
+		log.Println("Counting key use:", err)
+		return false
+	}
+
+	return true
+}
+
+// PruneExpiredKeys deletes keys that are past their expiration time or have
+// used up all their uses, along with the keys descended from them.
+func (db *GemDriveDatabase) PruneExpiredKeys() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	now := time.Now()
+	changes := newStoreChanges()
+
+	// Like revoking, this takes the key's descendants with it, so none are
+	// left behind with a missing parent.
+	expired := newStoreChanges()
+	for id, keyData := range db.Keys {
+		if keyData.IsExpired(now) {
+			db.deleteKeyTree(id, expired)
+		}
+	}
+
+	// Descendants that expired themselves come up more than once
+	deleted := make(map[string]bool)
+	for _, id := range expired.DeleteKeys {
+		if !deleted[id] {
+			deleted[id] = true
+			changes.DeleteKeys = append(changes.DeleteKeys, id)
+		}
+	}
+
+	err := db.commit(changes)
+	if err != nil {
+		log.Println("Pruning expired keys:", err)
+	}
+}
+
+// DeleteKeyTree deletes a key along with every key descended from it.
+func (db *GemDriveDatabase) DeleteKeyTree(id string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	_, exists := db.Keys[id]
+
+	if !exists {
+		return errors.New("No such key")
+	}
+
+	changes := newStoreChanges()
+	db.deleteKeyTree(id, changes)
+
+	return db.commit(changes)
+}
+
+func (db *GemDriveDatabase) deleteKeyTree(id string, changes *StoreChanges) {
+	for descendant := range db.descendants(id) {
+		changes.DeleteKeys = append(changes.DeleteKeys, descendant)
+	}
+
+	changes.DeleteKeys = append(changes.DeleteKeys, id)
 }
 
-func (db *GemDriveDatabase) GetMasterKey() (string, error) {
+// GetDescendants returns every key created by the given key, directly or
+// through its children, indexed by ID.
+func (db *GemDriveDatabase) GetDescendants(id string) map[string]*KeyData {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.descendants(id)
+}
 
+// IsDescendant reports whether a key was created by ancestor, directly or
+// through its children.
+func (db *GemDriveDatabase) IsDescendant(id, ancestorId string) bool {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	for key, keyData := range db.Keys {
+	keyData, exists := db.Keys[id]
+
+	for i := 0; exists && keyData.Parent != "" && i <= len(db.Keys); i++ {
+		if keyData.Parent == ancestorId {
+			return true
+		}
+		keyData, exists = db.Keys[keyData.Parent]
+	}
+
+	return false
+}
+
+func (db *GemDriveDatabase) descendants(id string) map[string]*KeyData {
+
+	children := make(map[string][]string)
+	for k, keyData := range db.Keys {
+		children[keyData.Parent] = append(children[keyData.Parent], k)
+	}
+
+	result := make(map[string]*KeyData)
+
+	pending := children[id]
+	for len(pending) > 0 {
+		k := pending[0]
+		pending = pending[1:]
+
+		result[k] = db.Keys[k]
+		pending = append(pending, children[k]...)
+	}
+
+	return result
+}
+
+func (db *GemDriveDatabase) GetMasterKeyId() (string, error) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.masterKeyId()
+}
+
+func (db *GemDriveDatabase) masterKeyId() (string, error) {
+	for id, keyData := range db.Keys {
 		if keyData.Parent == "" {
-			return key, nil
+			return id, nil
 		}
 	}
 
 	return "", errors.New("No master key")
 }
 
+// GetKeyData looks up the data for a raw key, checking it against the
+// stored hash.
 func (db *GemDriveDatabase) GetKeyData(key string) (*KeyData, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	keyData, exists := db.Keys[key]
+	_, keyData, err := db.lookupKey(key)
+	return keyData, err
+}
+
+// GetKeyId returns the ID of a raw key, once it's been checked against the
+// stored hash.
+func (db *GemDriveDatabase) GetKeyId(key string) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id, _, err := db.lookupKey(key)
+	return id, err
+}
+
+func (db *GemDriveDatabase) lookupKey(key string) (string, *KeyData, error) {
+
+	id, found := splitKeyId(key)
+	if !found {
+		id, found = db.bareKeyId(key)
+		if !found {
+			return "", nil, errors.New("Invalid key")
+		}
+	}
+
+	keyData, err := db.keyDataById(id)
+	if err != nil || !keyData.matchesKey(key) {
+		return "", nil, errors.New("Invalid key")
+	}
+
+	return id, keyData, nil
+}
+
+// bareKeyId finds the ID of a key that doesn't carry one. "public" is stored
+// under its own name. Bare keys have to be checked one by one, but there are
+// only ever the ones the key ID migration left, and fewer as they're
+// replaced.
+func (db *GemDriveDatabase) bareKeyId(key string) (string, bool) {
+
+	if key == "public" {
+		return key, true
+	}
+
+	for id := range db.bareIds {
+		if db.Keys[id].matchesKey(key) {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+func (db *GemDriveDatabase) GetKeyDataById(id string) (*KeyData, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.keyDataById(id)
+}
+
+func (db *GemDriveDatabase) keyDataById(id string) (*KeyData, error) {
+
+	keyData, exists := db.Keys[id]
 
 	if !exists {
 		return nil, errors.New("Invalid key")
 	}
 
+	// Keys whose parent has been revoked are revoked too. Revocation
+	// deletes the whole tree, but databases from before that was the case
+	// may still have orphans.
+	for i, parent := 0, keyData.Parent; parent != ""; i++ {
+		parentData, exists := db.Keys[parent]
+		if !exists || i > len(db.Keys) {
+			return nil, errors.New("Invalid key")
+		}
+		parent = parentData.Parent
+	}
+
 	return keyData, nil
 }
+
+func (db *GemDriveDatabase) GetUser(username string) (*UserData, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	userData, exists := db.Users[username]
+	if !exists {
+		return nil, errors.New("No such user")
+	}
+
+	return userData, nil
+}
+
+// SetUser creates or replaces a user. Replacing one revokes the old user key,
+// which logs out all of their sessions.
+func (db *GemDriveDatabase) SetUser(username string, userData *UserData) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	changes := newStoreChanges()
+
+	old, exists := db.Users[username]
+	if exists && old.KeyId != userData.KeyId {
+		db.deleteKeyTree(old.KeyId, changes)
+	}
+
+	changes.PutUsers[username] = userData
+
+	return db.commit(changes)
+}
+
+func (db *GemDriveDatabase) DeleteUser(username string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	userData, exists := db.Users[username]
+	if !exists {
+		return errors.New("No such user")
+	}
+
+	changes := newStoreChanges()
+	db.deleteKeyTree(userData.KeyId, changes)
+	changes.DeleteUsers = []string{username}
+
+	return db.commit(changes)
+}
@@ -0,0 +1,253 @@
+package gemdrive
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyIdsAreIndependentOfKeys(t *testing.T) {
+
+	db, err := NewGemDriveDatabase(NewJsonStore(filepath.Join(t.TempDir(), "gemdrive_db.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only keys from before IDs existed can be bare
+	_, err = db.SetKeyData("abcdefgh1", &KeyData{Privileges: map[string]string{}})
+	if err == nil {
+		t.Fatal("New bare key was accepted")
+	}
+
+	key, err := genKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := db.SetKeyData(key, &KeyData{Privileges: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key, id+".") {
+		t.Fatalf("Key %s doesn't carry its ID %s", key, id)
+	}
+
+	if _, err := db.GetKeyData(id + ".wrong"); err == nil {
+		t.Fatal("Key with the right ID but the wrong secret was accepted")
+	}
+}
+
+func TestMigrateKeyIds(t *testing.T) {
+
+	dbPath := filepath.Join(t.TempDir(), "gemdrive_db.json")
+
+	masterKey := "abcdefgh" + strings.Repeat("m", 24)
+	childKey := "abcdefgh" + strings.Repeat("c", 24)
+
+	// Raw keys, as stored before keys were hashed
+	err := saveJson(&StoreData{
+		Keys: map[string]*KeyData{
+			masterKey: {Privileges: map[string]string{"/": "write"}},
+			childKey:  {Parent: masterKey, Privileges: map[string]string{"/docs": "read"}},
+			"public":  {Parent: masterKey, Privileges: map[string]string{}},
+		},
+		Users: map[string]*UserData{
+			"alice": {KeyId: childKey},
+		},
+	}, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewGemDriveDatabase(NewJsonStore(dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masterId, err := db.GetKeyId(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	childId, err := db.GetKeyId(childKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{masterId, childId} {
+		if strings.HasPrefix(masterKey, id) || strings.HasPrefix(childKey, id) {
+			t.Fatalf("Migrated ID %s is a prefix of a key", id)
+		}
+	}
+
+	childData, _ := db.GetKeyDataById(childId)
+	if childData.Parent != masterId {
+		t.Fatalf("Child's parent is %s, want %s", childData.Parent, masterId)
+	}
+
+	publicData, err := db.GetKeyData("public")
+	if err != nil || publicData.Parent != masterId {
+		t.Fatalf("Public key not migrated: %v", err)
+	}
+
+	user, _ := db.GetUser("alice")
+	if user.KeyId != childId {
+		t.Fatalf("User key ID is %s, want %s", user.KeyId, childId)
+	}
+
+	// Reopening doesn't migrate again
+	db, err = NewGemDriveDatabase(NewJsonStore(dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, _ := db.GetKeyId(masterKey); id != masterId {
+		t.Fatalf("Master key ID changed from %s to %s", masterId, id)
+	}
+}
+
+func TestMigratePrivileges(t *testing.T) {
+
+	dbPath := filepath.Join(t.TempDir(), "gemdrive_db.json")
+
+	key, err := genKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := splitKeyId(key)
+
+	salt, hash, err := hashKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys already have random IDs, but read still means what it used to
+	err = saveJson(&StoreData{
+		Version: 1,
+		Keys: map[string]*KeyData{
+			id: {
+				Privileges: map[string]string{"/": "write", "/docs": "read", "/drop": "create"},
+				Salt:       salt,
+				Hash:       hash,
+			},
+		},
+	}, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewGemDriveDatabase(NewJsonStore(dbPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyData, err := db.GetKeyData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"/": "write", "/docs": "list,read,manage-keys", "/drop": "create"}
+	for pattern, perm := range expected {
+		if keyData.Privileges[pattern] != perm {
+			t.Errorf("%s: got %q, want %q", pattern, keyData.Privileges[pattern], perm)
+		}
+	}
+
+	if !(&KeyData{Privileges: map[string]string{"/docs": "read"}}).IsSubsetOf(keyData.Delegatable()) {
+		t.Error("Migrated read privilege can't create read keys")
+	}
+}
+
+func TestUseKeyLimitsConcurrentUses(t *testing.T) {
+
+	db, err := NewGemDriveDatabase(NewJsonStore(filepath.Join(t.TempDir(), "gemdrive_db.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := genKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.SetKeyData(key, &KeyData{
+		Privileges: map[string]string{"/": "read"},
+		MaxUses:    3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			results <- db.UseKey(key)
+		}()
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if <-results {
+			allowed++
+		}
+	}
+
+	if allowed != 3 {
+		t.Fatalf("%d uses allowed, want 3", allowed)
+	}
+
+	keyData, err := db.GetKeyData(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking privileges during the last request still works
+	if !keyData.IsValid() {
+		t.Fatal("Key isn't valid during its last use")
+	}
+}
+
+func TestPruneExpiredKeysTakesDescendants(t *testing.T) {
+
+	db, err := NewGemDriveDatabase(NewJsonStore(filepath.Join(t.TempDir(), "gemdrive_db.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	setKey := func(keyData *KeyData) string {
+		t.Helper()
+
+		key, err := genKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := db.SetKeyData(key, keyData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return id
+	}
+
+	parentId := setKey(&KeyData{
+		Privileges: map[string]string{"/": "read"},
+		ExpiresAt:  time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	})
+
+	childId := setKey(&KeyData{
+		Parent:     parentId,
+		Privileges: map[string]string{"/": "read"},
+	})
+
+	db.PruneExpiredKeys()
+
+	for _, id := range []string{parentId, childId} {
+		if _, err := db.GetKeyDataById(id); err == nil {
+			t.Fatalf("Key %s is still there after pruning", id)
+		}
+	}
+}
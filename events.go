@@ -0,0 +1,270 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventsPrefix = "/gemdrive/events"
+
+// Writes made through the server are usually also picked up by the backend
+// watcher. Watcher events for a path the server just reported are dropped,
+// as are repeats of the same watcher event, within this window.
+const eventDedupeWindow = 2 * time.Second
+
+// The watcher often notices a change before the server has finished the
+// request that made it, so watcher events are held back briefly before
+// deciding whether they are duplicates.
+const externalEventDelay = 250 * time.Millisecond
+
+const eventKeepAliveInterval = 30 * time.Second
+
+type eventHub struct {
+	mut         sync.Mutex
+	subscribers map[chan *Event]bool
+	recent      map[string]time.Time
+	external    chan externalEvent
+}
+
+type externalEvent struct {
+	event      *Event
+	receivedAt time.Time
+}
+
+func newEventHub() *eventHub {
+	h := &eventHub{
+		subscribers: make(map[chan *Event]bool),
+		recent:      make(map[string]time.Time),
+		external:    make(chan externalEvent, 1024),
+	}
+
+	go func() {
+		for e := range h.external {
+			time.Sleep(time.Until(e.receivedAt.Add(externalEventDelay)))
+			h.deliver(e.event, true)
+		}
+	}()
+
+	return h
+}
+
+func (h *eventHub) subscribe() chan *Event {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	ch := make(chan *Event, 256)
+	h.subscribers[ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *Event) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish delivers an event to every subscriber. external is true for events
+// coming from a backend Watcher rather than from the server itself.
+func (h *eventHub) publish(event *Event, external bool) {
+	if external {
+		h.external <- externalEvent{event, time.Now()}
+		return
+	}
+
+	h.deliver(event, false)
+}
+
+func (h *eventHub) deliver(event *Event, external bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	now := time.Now()
+
+	if len(h.recent) > 4096 {
+		for k, t := range h.recent {
+			if now.Sub(t) > eventDedupeWindow {
+				delete(h.recent, k)
+			}
+		}
+	}
+
+	pathKey := strings.TrimSuffix(event.Path, "/")
+
+	if external {
+		eventKey := event.Type + ":" + pathKey
+
+		if t, ok := h.recent[pathKey]; ok && now.Sub(t) < eventDedupeWindow {
+			return
+		}
+		if t, ok := h.recent[eventKey]; ok && now.Sub(t) < eventDedupeWindow {
+			return
+		}
+
+		h.recent[eventKey] = now
+
+		// A new file is reported as created and then written to
+		if event.Type == "create" {
+			h.recent["modify:"+pathKey] = now
+		}
+	} else {
+		h.recent[pathKey] = now
+		if event.OldPath != "" {
+			h.recent[strings.TrimSuffix(event.OldPath, "/")] = now
+		}
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// The client isn't keeping up. Disconnecting it is better
+			// than silently dropping events; EventSource clients will
+			// reconnect on their own.
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *Server) emit(eventType, reqPath string) {
+	s.events.publish(&Event{Type: eventType, Path: reqPath}, false)
+}
+
+func (s *Server) emitRename(oldPath, newPath string) {
+	s.events.publish(&Event{Type: "rename", Path: newPath, OldPath: oldPath}, false)
+}
+
+// writeEventType reports whether a write to reqPath is going to create a new
+// file or modify an existing one. Must be called before the write.
+func (s *Server) writeEventType(reqPath string, overwrite bool) string {
+	if !overwrite {
+		return "create"
+	}
+
+	_, _, err := statItem(s.backend, reqPath)
+	if err != nil {
+		return "create"
+	}
+
+	return "modify"
+}
+
+// Watching is started when the first client subscribes, since setting up
+// inotify watches on a large tree isn't free.
+func (s *Server) startWatching() {
+	s.watchOnce.Do(func() {
+		watcher, ok := s.backend.(Watcher)
+		if !ok {
+			return
+		}
+
+		err := watcher.Watch(func(event *Event) {
+			s.events.publish(event, true)
+		})
+		if err != nil {
+			fmt.Println("events: watching backend failed:", err)
+		}
+	})
+}
+
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+
+	token, _ := extractToken(r)
+
+	if token == "" {
+		token = "public"
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Streaming not supported")
+		return
+	}
+
+	// No read check on the root itself. Events are filtered individually,
+	// so subscribing to a directory only delivers changes to the parts of
+	// it the caller is allowed to see.
+	rootPath := dirPath(mappedRoot + strings.TrimPrefix(r.URL.Path, eventsPrefix))
+
+	visible := func(p string) bool {
+		inTree := strings.HasPrefix(p, rootPath) || p+"/" == rootPath
+		return inTree && s.keyAuth.CanRead(token, p)
+	}
+
+	s.startWatching()
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			out := *event
+
+			// Renames across the edge of what the caller can see look
+			// like a create or delete from their point of view.
+			if out.Type == "rename" {
+				newVisible := visible(out.Path)
+				oldVisible := visible(out.OldPath)
+
+				if newVisible && !oldVisible {
+					out = Event{Type: "create", Path: out.Path}
+				} else if oldVisible && !newVisible {
+					out = Event{Type: "delete", Path: out.OldPath}
+				} else if !newVisible {
+					continue
+				}
+			} else if !visible(out.Path) {
+				continue
+			}
+
+			out.Path = strings.TrimPrefix(out.Path, mappedRoot)
+			if out.OldPath != "" {
+				out.OldPath = strings.TrimPrefix(out.OldPath, mappedRoot)
+			}
+
+			data, err := json.Marshal(out)
+			if err != nil {
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", out.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
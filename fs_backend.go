@@ -2,6 +2,8 @@ package gemdrive
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/nfnt/resize"
@@ -14,6 +16,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -52,30 +55,35 @@ func (fs *FileSystemBackend) List(reqPath string, depth int) (*Item, error) {
 
 	if depth > maxAllowedDepth {
 		errMsg := fmt.Sprintf("max-depth is greater than allowed value (%d)", maxAllowedDepth)
-		return nil, errors.New(errMsg)
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  errMsg,
+		}
 	}
 
 	p := path.Join(fs.rootDir, reqPath)
 
-	dir, err := os.Open(p)
+	stat, err := os.Stat(p)
 	if err != nil {
-		return nil, errors.New("List: could not open directory")
+		return nil, fsError(err)
 	}
 
-	stat, err := dir.Stat()
-	if err != nil {
-		return nil, errors.New("List: could not stat directory")
+	if !stat.IsDir() {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  "Not a directory",
+		}
 	}
 
 	files, err := ReadDir(p)
 	if err != nil {
-		return nil, err
+		return nil, fsError(err)
 	}
 
 	item := DirToGemDrive(files)
 
 	item.Size = stat.Size()
-	item.ModTime = stat.ModTime().UTC().Format(time.RFC3339)
+	item.ModTime = stat.ModTime().UTC().Format(time.RFC3339Nano)
 
 	if depth == 1 {
 		return item, nil
@@ -112,32 +120,47 @@ func (fs *FileSystemBackend) Read(reqPath string, offset, length int64) (*Item,
 
 	file, err := os.Open(p)
 	if err != nil {
-		return nil, nil, &Error{
-			HttpCode: 404,
-			Message:  "Not found",
-		}
+		return nil, nil, fsError(err)
 	}
 
-	file.Seek(offset, 0)
+	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return nil, nil, &Error{
 			HttpCode: 500,
-			Message:  "Error seeking file",
+			Message:  "Error stat'ing file",
 		}
 	}
 
-	stat, err := file.Stat()
+	if stat.IsDir() {
+		file.Close()
+		return nil, nil, &Error{
+			HttpCode: 400,
+			Message:  "Is a directory",
+		}
+	}
+
+	if offset < 0 || offset > stat.Size() || length < 0 {
+		file.Close()
+		return nil, nil, &Error{
+			HttpCode: 416,
+			Message:  "Invalid range",
+		}
+	}
+
+	_, err = file.Seek(offset, 0)
 	if err != nil {
+		file.Close()
 		return nil, nil, &Error{
 			HttpCode: 500,
-			Message:  "Error stat'ing file",
+			Message:  "Error seeking file",
 		}
 	}
 
 	reader, writer := io.Pipe()
 
 	copyLength := length
-	if length == 0 {
+	if length == 0 || offset+length > stat.Size() {
 		copyLength = stat.Size() - offset
 	}
 
@@ -157,7 +180,7 @@ func (fs *FileSystemBackend) Read(reqPath string, offset, length int64) (*Item,
 
 	item := &Item{
 		Size:         stat.Size(),
-		ModTime:      stat.ModTime().UTC().Format(time.RFC3339),
+		ModTime:      stat.ModTime().UTC().Format(time.RFC3339Nano),
 		IsExecutable: IsExecutable(stat),
 	}
 
@@ -170,18 +193,21 @@ func (fs *FileSystemBackend) MakeDir(reqPath string, recursive bool) error {
 	if recursive {
 		err := os.MkdirAll(fsPath, 0755)
 		if err != nil {
-			return err
+			return fsError(err)
 		}
 	} else {
 		_, err := os.Stat(fsPath)
 		exists := !os.IsNotExist(err)
 
 		if exists {
-			return errors.New("Directory exists")
+			return &Error{
+				HttpCode: 409,
+				Message:  "Directory exists",
+			}
 		} else {
 			err := os.Mkdir(fsPath, 0755)
 			if err != nil {
-				return err
+				return fsError(err)
 			}
 		}
 	}
@@ -191,6 +217,13 @@ func (fs *FileSystemBackend) MakeDir(reqPath string, recursive bool) error {
 
 func (fs *FileSystemBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
 
+	if offset < 0 {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Invalid offset",
+		}
+	}
+
 	fsPath := path.Join(fs.rootDir, reqPath)
 
 	mask := os.O_WRONLY | os.O_CREATE
@@ -205,7 +238,7 @@ func (fs *FileSystemBackend) Write(reqPath string, data io.Reader, offset, lengt
 
 	file, err := os.OpenFile(fsPath, mask, 0666)
 	if err != nil {
-		return err
+		return fsError(err)
 	}
 	defer file.Close()
 
@@ -219,8 +252,12 @@ func (fs *FileSystemBackend) Write(reqPath string, data io.Reader, offset, lengt
 		return err
 	}
 
-	if n != length {
-		return errors.New("n did not match length")
+	// A negative length means the length isn't known in advance.
+	if length >= 0 && n != length {
+		return &Error{
+			HttpCode: 400,
+			Message:  "n did not match length",
+		}
 	}
 
 	return nil
@@ -233,12 +270,17 @@ func (fs *FileSystemBackend) SetAttributes(reqPath string, modTime time.Time, is
 	accessTime := modTime
 	err := os.Chtimes(fsPath, accessTime, modTime)
 	if err != nil {
-		return err
+		return fsError(err)
 	}
 
 	fileInfo, err := os.Stat(fsPath)
 	if err != nil {
-		return err
+		return fsError(err)
+	}
+
+	// Directories need their execute bits to be usable
+	if fileInfo.IsDir() {
+		return nil
 	}
 
 	perms := fileInfo.Mode().Perm()
@@ -247,9 +289,13 @@ func (fs *FileSystemBackend) SetAttributes(reqPath string, modTime time.Time, is
 
 	if currentlyExecutable != isExecutable {
 		newPerms := perms | 0111
+		if !isExecutable {
+			newPerms = perms &^ 0111
+		}
+
 		err = os.Chmod(fsPath, newPerms)
 		if err != nil {
-			return err
+			return fsError(err)
 		}
 	}
 
@@ -260,21 +306,118 @@ func (fs *FileSystemBackend) Delete(reqPath string, recursive bool) error {
 
 	fsPath := path.Join(fs.rootDir, reqPath)
 
+	if fsPath == path.Clean(fs.rootDir) {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Can't delete the root directory",
+		}
+	}
+
+	// os.RemoveAll doesn't mind if there's nothing there
+	_, err := os.Lstat(fsPath)
+	if err != nil {
+		return fsError(err)
+	}
+
 	if recursive {
 		err := os.RemoveAll(fsPath)
 		if err != nil {
-			return err
+			return fsError(err)
 		}
 	} else {
 		err := os.Remove(fsPath)
 		if err != nil {
-			return err
+			return fsError(err)
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileSystemBackend) Move(srcPath, dstPath string, overwrite bool) error {
+
+	fsSrcPath := path.Join(fs.rootDir, srcPath)
+	fsDstPath := path.Join(fs.rootDir, dstPath)
+
+	_, err := os.Stat(fsSrcPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
 		}
 	}
 
+	if fsDstPath == fsSrcPath || strings.HasPrefix(fsDstPath, fsSrcPath+"/") {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Can't move a directory into itself",
+		}
+	}
+
+	dstStat, err := os.Stat(fsDstPath)
+	if err == nil {
+		if !overwrite {
+			return &Error{
+				HttpCode: 409,
+				Message:  "Destination exists",
+			}
+		}
+
+		// os.Rename won't replace a non-empty directory
+		if dstStat.IsDir() {
+			err := os.RemoveAll(fsDstPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = os.Rename(fsSrcPath, fsDstPath)
+	if err != nil {
+		return fsError(err)
+	}
+
 	return nil
 }
 
+func (fs *FileSystemBackend) Copy(srcPath, dstPath string, overwrite bool) error {
+
+	fsSrcPath := path.Join(fs.rootDir, srcPath)
+	fsDstPath := path.Join(fs.rootDir, dstPath)
+
+	_, err := os.Stat(fsSrcPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if fsDstPath == fsSrcPath || strings.HasPrefix(fsDstPath, fsSrcPath+"/") {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Can't copy a directory into itself",
+		}
+	}
+
+	_, err = os.Stat(fsDstPath)
+	if err == nil {
+		if !overwrite {
+			return &Error{
+				HttpCode: 409,
+				Message:  "Destination exists",
+			}
+		}
+
+		err := os.RemoveAll(fsDstPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return copyTree(fs, srcPath, fs, dstPath)
+}
+
 func (fs *FileSystemBackend) GetImage(reqPath string, size int) (io.Reader, int64, error) {
 
 	p := path.Join(fs.rootDir, reqPath)
@@ -342,6 +485,146 @@ func (fs *FileSystemBackend) GetImage(reqPath string, size int) (io.Reader, int6
 
 }
 
+type hashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Hash    string `json:"hash"`
+}
+
+func (fs *FileSystemBackend) GetHash(reqPath string, algorithm string) (string, error) {
+
+	if algorithm != HashSha256 {
+		return "", &Error{
+			HttpCode: 400,
+			Message:  "Unsupported hash algorithm",
+		}
+	}
+
+	p := path.Join(fs.rootDir, reqPath)
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "", &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if stat.IsDir() {
+		return "", &Error{
+			HttpCode: 400,
+			Message:  "Can't hash a directory",
+		}
+	}
+
+	cachePath := fs.hashCachePath(reqPath, algorithm)
+
+	if hash, ok := loadCachedHash(cachePath, stat); ok {
+		return hash, nil
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	entry := &hashCacheEntry{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UnixNano(),
+		Hash:    hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	err = os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err == nil {
+		err = saveJson(entry, cachePath)
+	}
+	if err != nil {
+		fmt.Println("Failed to cache hash for", reqPath, err)
+	}
+
+	return entry.Hash, nil
+}
+
+func (fs *FileSystemBackend) GetCachedHash(reqPath string, algorithm string) (string, bool) {
+
+	if algorithm != HashSha256 {
+		return "", false
+	}
+
+	stat, err := os.Stat(path.Join(fs.rootDir, reqPath))
+	if err != nil || stat.IsDir() {
+		return "", false
+	}
+
+	return loadCachedHash(fs.hashCachePath(reqPath, algorithm), stat)
+}
+
+// Hashes are cached alongside the image thumbnails, and are recomputed
+// whenever the size or mod time changes.
+func (fs *FileSystemBackend) hashCachePath(reqPath string, algorithm string) string {
+	pathParts := strings.Split(reqPath, "/")
+	parentDir := strings.Join(pathParts[:len(pathParts)-1], "/")
+	filename := pathParts[len(pathParts)-1]
+
+	return path.Join(fs.gemDir, parentDir, "gemdrive", "hashes", algorithm, filename+".json")
+}
+
+func loadCachedHash(cachePath string, stat os.FileInfo) (string, bool) {
+	cached := &hashCacheEntry{}
+	err := loadJson(cached, cachePath)
+	if err != nil || cached.Size != stat.Size() || cached.ModTime != stat.ModTime().UnixNano() {
+		return "", false
+	}
+	return cached.Hash, true
+}
+
+// fsError converts errors from the os package to an *Error with the matching
+// HTTP code, so callers can tell what went wrong.
+func fsError(err error) error {
+	// os.IsExist is true for ENOTEMPTY too, so that's checked first.
+	switch {
+	case os.IsNotExist(err):
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return &Error{
+			HttpCode: 409,
+			Message:  "Directory not empty",
+		}
+	case os.IsExist(err):
+		return &Error{
+			HttpCode: 409,
+			Message:  "File exists",
+		}
+	case os.IsPermission(err):
+		return &Error{
+			HttpCode: 403,
+			Message:  "Permission denied",
+		}
+	case errors.Is(err, syscall.EISDIR):
+		return &Error{
+			HttpCode: 409,
+			Message:  "Is a directory",
+		}
+	case errors.Is(err, syscall.ENOTDIR):
+		return &Error{
+			HttpCode: 409,
+			Message:  "Not a directory",
+		}
+	}
+
+	return err
+}
+
 func decodeImage(filename string, reader io.Reader) (image.Image, error) {
 	ext := strings.ToLower(filepath.Ext(filename))
 
@@ -392,7 +675,7 @@ func DirToGemDrive(files []os.FileInfo) *Item {
 
 		item.Children[name] = &Item{
 			Size:         file.Size(),
-			ModTime:      file.ModTime().UTC().Format(time.RFC3339),
+			ModTime:      file.ModTime().UTC().Format(time.RFC3339Nano),
 			IsExecutable: isExecutable,
 		}
 	}
@@ -441,5 +724,10 @@ func ReadDir(dirPath string) ([]os.FileInfo, error) {
 var (
 	_ Backend         = (*FileSystemBackend)(nil)
 	_ WritableBackend = (*FileSystemBackend)(nil)
+	_ Mover           = (*FileSystemBackend)(nil)
+	_ Copier          = (*FileSystemBackend)(nil)
 	_ ImageServer     = (*FileSystemBackend)(nil)
+	_ Hasher          = (*FileSystemBackend)(nil)
+	_ CachedHasher    = (*FileSystemBackend)(nil)
+	_ Watcher         = (*FileSystemBackend)(nil)
 )
@@ -0,0 +1,18 @@
+package gemdrive_test
+
+import (
+	"testing"
+
+	"github.com/gemdrive/gemdrive-go"
+	"github.com/gemdrive/gemdrive-go/gemdrivetest"
+)
+
+func TestFileSystemBackend(t *testing.T) {
+
+	backend, err := gemdrive.NewFileSystemBackend(t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gemdrivetest.TestBackend(t, backend, "/")
+}
@@ -0,0 +1,103 @@
+package gemdrive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch reports changes made to the directory, including ones made by other
+// programs. Directories are watched recursively, and new directories are
+// picked up as they appear.
+func (fs *FileSystemBackend) Watch(callback func(*Event)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	err = fs.watchTree(watcher, fs.rootDir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case fsEvent, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				fs.handleWatchEvent(watcher, fsEvent, callback)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Println("watch:", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (fs *FileSystemBackend) watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Most likely removed while walking
+			return nil
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		// Don't report changes to thumbnails and hashes
+		if p == fs.gemDir {
+			return filepath.SkipDir
+		}
+
+		return watcher.Add(p)
+	})
+}
+
+func (fs *FileSystemBackend) handleWatchEvent(watcher *fsnotify.Watcher, fsEvent fsnotify.Event, callback func(*Event)) {
+
+	relPath, err := filepath.Rel(fs.rootDir, fsEvent.Name)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return
+	}
+
+	if strings.HasPrefix(fsEvent.Name, fs.gemDir+string(filepath.Separator)) {
+		return
+	}
+
+	reqPath := "/" + filepath.ToSlash(relPath)
+
+	switch {
+	case fsEvent.Op&fsnotify.Create != 0:
+		info, err := os.Stat(fsEvent.Name)
+		if err == nil && info.IsDir() {
+			reqPath += "/"
+
+			err := fs.watchTree(watcher, fsEvent.Name)
+			if err != nil {
+				fmt.Println("watch:", err)
+			}
+		}
+
+		callback(&Event{Type: "create", Path: reqPath})
+	case fsEvent.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// The new name of a renamed item shows up as a separate create.
+		// Drop any watch on the old name so it doesn't report events under
+		// a stale path.
+		watcher.Remove(fsEvent.Name)
+
+		callback(&Event{Type: "delete", Path: reqPath})
+	case fsEvent.Op&(fsnotify.Write|fsnotify.Chmod) != 0:
+		callback(&Event{Type: "modify", Path: reqPath})
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"time"
 )
 
+// ModTime is an RFC3339 timestamp, with fractional seconds if the backend
+// keeps track of them.
 type Item struct {
-	Size         int64            `json:"size,omitempty"`
-	ModTime      string           `json:"modTime,omitempty"`
-	Children     map[string]*Item `json:"children,omitempty"`
-	IsExecutable bool             `json:"isExecutable,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	ModTime      string            `json:"modTime,omitempty"`
+	Children     map[string]*Item  `json:"children,omitempty"`
+	IsExecutable bool              `json:"isExecutable,omitempty"`
+	Hashes       map[string]string `json:"hashes,omitempty"`
 }
 
 type RemoteGetRequest struct {
@@ -24,6 +27,52 @@ type RemoteGetRequest struct {
 	Truncate           bool   `json:"truncate,omitempty"`
 }
 
+type MoveRequest struct {
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+}
+
+type CopyRequest struct {
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+}
+
+// ModTime is an RFC3339 timestamp.
+type SetAttributesRequest struct {
+	Path         string `json:"path,omitempty"`
+	ModTime      string `json:"modTime,omitempty"`
+	IsExecutable bool   `json:"isExecutable,omitempty"`
+}
+
+type UserRequest struct {
+	Password   string            `json:"password,omitempty"`
+	Privileges map[string]string `json:"privileges,omitempty"`
+}
+
+// Range is an HTTP Range header value, e.g. "bytes=0-1023". ExpiresAt is an
+// RFC3339 timestamp and defaults to an hour from now.
+type SignRequest struct {
+	Path      string `json:"path,omitempty"`
+	Method    string `json:"method,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Range     string `json:"range,omitempty"`
+}
+
+type ExtractResult struct {
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Event describes a change to an item. Type is one of "create", "modify",
+// "delete" or "rename". For renames OldPath holds the previous location.
+type Event struct {
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+}
+
 type Backend interface {
 	List(path string, maxDepth int) (*Item, error)
 	Read(path string, offset, length int64) (*Item, io.ReadCloser, error)
@@ -36,10 +85,43 @@ type WritableBackend interface {
 	Delete(path string, recursive bool) error
 }
 
+// Mover is implemented by writable backends that can move items themselves.
+// For other backends the server copies the item and deletes the original.
+type Mover interface {
+	Move(srcPath, dstPath string, overwrite bool) error
+}
+
+// Copier is implemented by writable backends that can copy items
+// themselves. For other backends the server copies through Read and Write.
+type Copier interface {
+	Copy(srcPath, dstPath string, overwrite bool) error
+}
+
 type ImageServer interface {
 	GetImage(path string, size int) (io.Reader, int64, error)
 }
 
+// Hashes are returned hex-encoded. The only supported algorithm is
+// HashSha256; others get a 400 error.
+type Hasher interface {
+	GetHash(path string, algorithm string) (string, error)
+}
+
+const HashSha256 = "sha256"
+
+// CachedHasher is implemented by backends that keep hashes around. It only
+// returns a hash that's known without reading the file, so it's cheap
+// enough to call on every request.
+type CachedHasher interface {
+	GetCachedHash(path string, algorithm string) (string, bool)
+}
+
+// Watcher is implemented by backends that can detect changes made outside of
+// GemDrive.
+type Watcher interface {
+	Watch(callback func(*Event)) error
+}
+
 type Error struct {
 	HttpCode int
 	Message  string
@@ -54,13 +136,55 @@ type Override struct {
 }
 
 type Config struct {
-	DashboardDomain string               `json:"dashboard_domain,omitempty"`
-	FsDomain        string               `json:"fs_domain,omitempty"`
-	Port            int                  `json:"port,omitempty"`
-	Dirs            []string             `json:"dirs,omitempty"`
-	DataDir         string               `json:"dataDir,omitempty"`
-	CacheDir        string               `json:"cacheDir,omitempty"`
-	RcloneDir       string               `json:"rcloneDir,omitempty"`
-	DomainMap       map[string]string    `json:"domainMap,omitempty"`
-	Overrides       map[string]*Override `json:"overrides",omitempty"`
+	DashboardDomain            string               `json:"dashboard_domain,omitempty"`
+	FsDomain                   string               `json:"fs_domain,omitempty"`
+	Port                       int                  `json:"port,omitempty"`
+	Dirs                       []string             `json:"dirs,omitempty"`
+	MemoryDirs                 []string             `json:"memoryDirs,omitempty"`
+	MemoryDirMaxSize           int64                `json:"memoryDirMaxSize,omitempty"`
+	Remotes                    map[string]*Remote   `json:"remotes,omitempty"`
+	DataDir                    string               `json:"dataDir,omitempty"`
+	DbStore                    string               `json:"dbStore,omitempty"`
+	AuditMaxSize               int64                `json:"auditMaxSize,omitempty"`
+	AuditMaxFiles              int                  `json:"auditMaxFiles,omitempty"`
+	ExtractMaxSize             int64                `json:"extractMaxSize,omitempty"`
+	ExtractMaxUncompressedSize int64                `json:"extractMaxUncompressedSize,omitempty"`
+	ExtractMaxEntries          int                  `json:"extractMaxEntries,omitempty"`
+	CacheDir                   string               `json:"cacheDir,omitempty"`
+	RcloneDir                  string               `json:"rcloneDir,omitempty"`
+	DomainMap                  map[string]string    `json:"domainMap,omitempty"`
+	Overrides                  map[string]*Override `json:"overrides,omitempty"`
+	Oidc                       *OidcConfig          `json:"oidc,omitempty"`
+}
+
+// Remote is a directory on another GemDrive server, mounted under the name
+// it's given in Config.Remotes. Url can include a path, e.g.
+// https://example.com/photos.
+type Remote struct {
+	Url string `json:"url"`
+	Key string `json:"key"`
+}
+
+// OidcConfig enables logging in with an OpenID Connect provider. RedirectUrl
+// is where the provider sends users back to, and needs to point at
+// /gemdrive/oidc/callback on this server. GroupsClaim defaults to "groups".
+type OidcConfig struct {
+	Issuer       string               `json:"issuer"`
+	ClientId     string               `json:"clientId"`
+	ClientSecret string               `json:"clientSecret,omitempty"`
+	RedirectUrl  string               `json:"redirectUrl"`
+	Scopes       []string             `json:"scopes,omitempty"`
+	GroupsClaim  string               `json:"groupsClaim,omitempty"`
+	Templates    []*PrivilegeTemplate `json:"templates,omitempty"`
+}
+
+// PrivilegeTemplate grants privileges to users whose claims match. Email may
+// be a glob, e.g. "*@example.com", and only matches verified addresses. If
+// both Email and Group are set both have to match. "{email}" in a privilege
+// path is replaced with the user's email address. A template with neither
+// matches everyone who can log in with the provider.
+type PrivilegeTemplate struct {
+	Email      string            `json:"email,omitempty"`
+	Group      string            `json:"group,omitempty"`
+	Privileges map[string]string `json:"privileges"`
 }
@@ -0,0 +1,584 @@
+// Package gemdrivetest checks that backends behave the way the GemDrive
+// server expects. It's meant to be called from a backend's tests:
+//
+//	func TestMemoryBackend(t *testing.T) {
+//		gemdrivetest.TestBackend(t, gemdrive.NewMemoryBackend(0), "/")
+//	}
+package gemdrivetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gemdrive/gemdrive-go"
+)
+
+// Fixture is the tree TestReadBackend expects to find, by path relative to
+// the directory being tested. Paths ending in "/" are empty directories.
+var Fixture = map[string]string{
+	"digits.txt":         "0123456789",
+	"dir/a.txt":          "a",
+	"dir/sub/b.txt":      "bb",
+	"dir/sub/deep/c.txt": "ccc",
+	"empty/":             "",
+}
+
+// WriteFixture creates Fixture in dir.
+func WriteFixture(backend gemdrive.WritableBackend, dir string) error {
+	dir = dirPath(dir)
+
+	for name, content := range Fixture {
+		p := dir + name
+
+		if strings.HasSuffix(name, "/") {
+			err := backend.MakeDir(p, true)
+			if err != nil {
+				return fmt.Errorf("MakeDir %s: %w", p, err)
+			}
+			continue
+		}
+
+		err := backend.MakeDir(path.Dir(p), true)
+		if err != nil {
+			return fmt.Errorf("MakeDir %s: %w", path.Dir(p), err)
+		}
+
+		err = backend.Write(p, strings.NewReader(content), 0, int64(len(content)), false, false)
+		if err != nil {
+			return fmt.Errorf("Write %s: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// TestBackend checks every Backend and WritableBackend method, plus Copy and
+// Move if the backend implements both Copier and Mover. It writes
+// Fixture along with a few scratch directories into dir, which must exist
+// and be empty. Each group of checks runs as its own subtest when tb is a
+// *testing.T.
+func TestBackend(tb testing.TB, backend gemdrive.Backend, dir string) {
+	tb.Helper()
+
+	dir = dirPath(dir)
+
+	writable, ok := backend.(gemdrive.WritableBackend)
+	if !ok {
+		tb.Fatal("backend doesn't implement WritableBackend")
+	}
+
+	err := WriteFixture(writable, dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	run(tb, backend, "List", func(t *tester) { t.checkList(dir) })
+	run(tb, backend, "Read", func(t *tester) { t.checkRead(dir) })
+	run(tb, backend, "MakeDir", func(t *tester) { t.checkMakeDir(dir + "mkdir/") })
+	run(tb, backend, "Write", func(t *tester) { t.checkWrite(dir + "write/") })
+	run(tb, backend, "SetAttributes", func(t *tester) { t.checkSetAttributes(dir + "attrs/") })
+	run(tb, backend, "Delete", func(t *tester) { t.checkDelete(dir + "delete/") })
+
+	_, isCopier := backend.(gemdrive.Copier)
+	_, isMover := backend.(gemdrive.Mover)
+	if isCopier && isMover {
+		run(tb, backend, "Transfer", func(t *tester) { t.checkTransfer(dir + "transfer/") })
+	}
+}
+
+// TestReadBackend checks List and Read against a copy of Fixture that
+// already exists in dir, for backends that can't be written to.
+func TestReadBackend(tb testing.TB, backend gemdrive.Backend, dir string) {
+	tb.Helper()
+
+	dir = dirPath(dir)
+
+	run(tb, backend, "List", func(t *tester) { t.checkList(dir) })
+	run(tb, backend, "Read", func(t *tester) { t.checkRead(dir) })
+}
+
+// run runs check as a subtest if tb supports them, otherwise directly with
+// its failures prefixed by name.
+func run(tb testing.TB, backend gemdrive.Backend, name string, check func(t *tester)) {
+	tb.Helper()
+
+	writable, _ := backend.(gemdrive.WritableBackend)
+
+	if t, ok := tb.(*testing.T); ok {
+		t.Run(name, func(t *testing.T) {
+			check(&tester{TB: t, backend: backend, writable: writable})
+		})
+		return
+	}
+
+	check(&tester{TB: tb, prefix: name + ": ", backend: backend, writable: writable})
+}
+
+type tester struct {
+	testing.TB
+	prefix   string
+	backend  gemdrive.Backend
+	writable gemdrive.WritableBackend
+}
+
+func (t *tester) errorf(format string, args ...interface{}) {
+	t.Helper()
+	t.Errorf(t.prefix+format, args...)
+}
+
+// expectCode reports a failure unless err is an *Error with the given code.
+func (t *tester) expectCode(what string, err error, code int) {
+	t.Helper()
+	if e, ok := err.(*gemdrive.Error); ok && e.HttpCode == code {
+		return
+	}
+	t.errorf("%s: expected *Error with code %d, got %v", what, code, err)
+}
+
+func (t *tester) expectOk(what string, err error) bool {
+	t.Helper()
+	if err != nil {
+		t.errorf("%s: %v", what, err)
+		return false
+	}
+	return true
+}
+
+func (t *tester) read(p string, offset, length int64) (*gemdrive.Item, string, error) {
+	item, data, err := t.backend.Read(p, offset, length)
+	if err != nil {
+		return nil, "", err
+	}
+	defer data.Close()
+
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return item, string(buf), nil
+}
+
+func (t *tester) expectContent(p string, expected string) {
+	t.Helper()
+	_, content, err := t.read(p, 0, 0)
+	if !t.expectOk("Read "+p, err) {
+		return
+	}
+
+	if content != expected {
+		t.errorf("Read %s: expected %q, got %q", p, expected, content)
+	}
+}
+
+// stat returns the listing entry for p from its parent directory.
+func (t *tester) stat(p string) *gemdrive.Item {
+	trimmed := strings.TrimSuffix(p, "/")
+	name := path.Base(trimmed)
+	if strings.HasSuffix(p, "/") {
+		name += "/"
+	}
+
+	parent, err := t.backend.List(dirPath(path.Dir(trimmed)), 1)
+	if err != nil {
+		return nil
+	}
+
+	return parent.Children[name]
+}
+
+func (t *tester) checkList(dir string) {
+
+	item, err := t.backend.List(dir, 1)
+	if t.expectOk("List depth 1", err) {
+		expectNames(t, "List depth 1", item, "digits.txt", "dir/", "empty/")
+
+		if child := item.Children["dir/"]; child != nil && child.Children != nil {
+			t.errorf("List depth 1: dir/ has children")
+		}
+
+		if child := item.Children["digits.txt"]; child != nil {
+			if child.Size != 10 {
+				t.errorf("List depth 1: digits.txt has size %d, expected 10", child.Size)
+			}
+
+			_, err := time.Parse(time.RFC3339, child.ModTime)
+			if err != nil {
+				t.errorf("List depth 1: digits.txt has invalid modTime %q", child.ModTime)
+			}
+		}
+	}
+
+	item, err = t.backend.List(dir, 2)
+	if t.expectOk("List depth 2", err) {
+		if child := item.Children["dir/"]; child != nil {
+			expectNames(t, "List depth 2: dir/", child, "a.txt", "sub/")
+
+			if sub := child.Children["sub/"]; sub != nil && sub.Children != nil {
+				t.errorf("List depth 2: dir/sub/ has children")
+			}
+		} else {
+			t.errorf("List depth 2: missing dir/")
+		}
+	}
+
+	item, err = t.backend.List(dir, 0)
+	if t.expectOk("List depth 0", err) {
+		c := walk(item, "dir/", "sub/", "deep/", "c.txt")
+		if c == nil {
+			t.errorf("List depth 0: missing dir/sub/deep/c.txt")
+		} else if c.Size != 3 {
+			t.errorf("List depth 0: dir/sub/deep/c.txt has size %d, expected 3", c.Size)
+		}
+	}
+
+	item, err = t.backend.List(dir+"dir/sub/", 1)
+	if t.expectOk("List subdirectory", err) {
+		expectNames(t, "List subdirectory", item, "b.txt", "deep/")
+	}
+
+	item, err = t.backend.List(dir+"empty/", 1)
+	if t.expectOk("List empty directory", err) && len(item.Children) != 0 {
+		t.errorf("List empty directory: has %d children", len(item.Children))
+	}
+
+	_, err = t.backend.List(dir+"missing/", 1)
+	t.expectCode("List missing directory", err, 404)
+
+	_, err = t.backend.List(dir+"digits.txt", 1)
+	t.expectCode("List file", err, 400)
+
+	_, err = t.backend.List(dir, 11)
+	t.expectCode("List depth 11", err, 400)
+}
+
+func (t *tester) checkRead(dir string) {
+
+	p := dir + "digits.txt"
+
+	ranges := []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 0, "0123456789"},
+		{2, 3, "234"},
+		{7, 0, "789"},
+		{7, 10, "789"},
+		{10, 0, ""},
+	}
+
+	for _, r := range ranges {
+		what := fmt.Sprintf("Read offset %d length %d", r.offset, r.length)
+
+		item, content, err := t.read(p, r.offset, r.length)
+		if !t.expectOk(what, err) {
+			continue
+		}
+
+		if content != r.expected {
+			t.errorf("%s: expected %q, got %q", what, r.expected, content)
+		}
+
+		if item.Size != 10 {
+			t.errorf("%s: item has size %d, expected the full size 10", what, item.Size)
+		}
+	}
+
+	_, _, err := t.read(p, 11, 0)
+	t.expectCode("Read past end", err, 416)
+
+	_, _, err = t.read(dir+"missing.txt", 0, 0)
+	t.expectCode("Read missing file", err, 404)
+
+	_, _, err = t.read(dir+"dir", 0, 0)
+	t.expectCode("Read directory", err, 400)
+}
+
+func (t *tester) checkMakeDir(dir string) {
+
+	if !t.expectOk("MakeDir", t.writable.MakeDir(dir, false)) {
+		return
+	}
+
+	t.expectCode("MakeDir existing", t.writable.MakeDir(dir, false), 409)
+	t.expectOk("MakeDir existing recursive", t.writable.MakeDir(dir, true))
+
+	t.expectCode("MakeDir missing parent", t.writable.MakeDir(dir+"a/b/", false), 404)
+
+	err := t.writable.MakeDir(dir+"a/b/c/", true)
+	if t.expectOk("MakeDir recursive", err) {
+		_, err := t.backend.List(dir+"a/b/c/", 1)
+		t.expectOk("List after MakeDir recursive", err)
+	}
+
+	err = t.writable.Write(dir+"file", strings.NewReader("x"), 0, 1, false, false)
+	if t.expectOk("Write", err) {
+		t.expectCode("MakeDir over file", t.writable.MakeDir(dir+"file/", true), 409)
+	}
+}
+
+func (t *tester) checkWrite(dir string) {
+
+	if !t.expectOk("MakeDir", t.writable.MakeDir(dir, false)) {
+		return
+	}
+
+	p := dir + "file.txt"
+
+	write := func(what, data string, offset int64, overwrite, truncate bool) error {
+		err := t.writable.Write(p, strings.NewReader(data), offset, int64(len(data)), overwrite, truncate)
+		t.expectOk(what, err)
+		return err
+	}
+
+	if write("Write new file", "hello", 0, false, false) != nil {
+		return
+	}
+	t.expectContent(p, "hello")
+
+	err := t.writable.Write(p, strings.NewReader("again"), 0, 5, false, false)
+	t.expectCode("Write existing without overwrite", err, 409)
+	t.expectContent(p, "hello")
+
+	if write("Write at start", "HE", 0, true, false) == nil {
+		t.expectContent(p, "HEllo")
+	}
+
+	if write("Write at end", "!!", 5, true, false) == nil {
+		t.expectContent(p, "HEllo!!")
+	}
+
+	if write("Write past end", "xyz", 10, true, false) == nil {
+		t.expectContent(p, "HEllo!!\x00\x00\x00xyz")
+	}
+
+	if write("Write with truncate", "new", 0, true, true) == nil {
+		t.expectContent(p, "new")
+	}
+
+	err = t.writable.Write(dir+"unknown.txt", strings.NewReader("abc"), 0, -1, false, false)
+	if t.expectOk("Write unknown length", err) {
+		t.expectContent(dir+"unknown.txt", "abc")
+	}
+
+	err = t.writable.Write(dir+"short.txt", strings.NewReader("abc"), 0, 5, false, false)
+	if err == nil {
+		t.errorf("Write with wrong length: expected error")
+	}
+
+	err = t.writable.Write(dir+"missing/file.txt", strings.NewReader("a"), 0, 1, false, false)
+	t.expectCode("Write with missing parent", err, 404)
+
+	err = t.writable.MakeDir(dir+"sub/", false)
+	if t.expectOk("MakeDir", err) {
+		err = t.writable.Write(dir+"sub", strings.NewReader("a"), 0, 1, true, true)
+		t.expectCode("Write over directory", err, 409)
+	}
+}
+
+func (t *tester) checkSetAttributes(dir string) {
+
+	if !t.expectOk("MakeDir", t.writable.MakeDir(dir, false)) {
+		return
+	}
+
+	p := dir + "file.txt"
+
+	err := t.writable.Write(p, strings.NewReader("#!/bin/sh\n"), 0, 10, false, false)
+	if !t.expectOk("Write", err) {
+		return
+	}
+
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	err = t.writable.SetAttributes(p, modTime, true)
+	if t.expectOk("SetAttributes executable", err) {
+		item := t.stat(p)
+		if item == nil {
+			t.errorf("SetAttributes executable: file missing from listing")
+		} else {
+			if item.ModTime != "2001-02-03T04:05:06Z" {
+				t.errorf("SetAttributes executable: modTime is %q", item.ModTime)
+			}
+			if !item.IsExecutable {
+				t.errorf("SetAttributes executable: not executable in listing")
+			}
+		}
+
+		item, _, err := t.read(p, 0, 0)
+		if t.expectOk("Read", err) && !item.IsExecutable {
+			t.errorf("SetAttributes executable: not executable in Read")
+		}
+	}
+
+	err = t.writable.SetAttributes(p, modTime.Add(time.Hour), false)
+	if t.expectOk("SetAttributes not executable", err) {
+		item := t.stat(p)
+		if item == nil {
+			t.errorf("SetAttributes not executable: file missing from listing")
+		} else {
+			if item.ModTime != "2001-02-03T05:05:06Z" {
+				t.errorf("SetAttributes not executable: modTime is %q", item.ModTime)
+			}
+			if item.IsExecutable {
+				t.errorf("SetAttributes not executable: still executable")
+			}
+		}
+	}
+
+	err = t.writable.SetAttributes(dir, modTime, false)
+	if t.expectOk("SetAttributes directory", err) {
+		item := t.stat(dir)
+		if item == nil {
+			t.errorf("SetAttributes directory: missing from listing")
+		} else if item.ModTime != "2001-02-03T04:05:06Z" {
+			t.errorf("SetAttributes directory: modTime is %q", item.ModTime)
+		}
+
+		_, err := t.backend.List(dir, 1)
+		t.expectOk("List after SetAttributes directory", err)
+	}
+
+	err = t.writable.SetAttributes(dir+"missing.txt", modTime, false)
+	t.expectCode("SetAttributes missing", err, 404)
+}
+
+func (t *tester) checkDelete(dir string) {
+
+	err := t.writable.MakeDir(dir+"tree/sub/", true)
+	if !t.expectOk("MakeDir", err) {
+		return
+	}
+
+	for _, p := range []string{dir + "file.txt", dir + "tree/a.txt", dir + "tree/sub/b.txt"} {
+		err := t.writable.Write(p, strings.NewReader("x"), 0, 1, false, false)
+		if !t.expectOk("Write "+p, err) {
+			return
+		}
+	}
+
+	if t.expectOk("Delete file", t.writable.Delete(dir+"file.txt", false)) {
+		_, _, err := t.read(dir+"file.txt", 0, 0)
+		t.expectCode("Read after Delete", err, 404)
+	}
+
+	t.expectCode("Delete missing", t.writable.Delete(dir+"missing.txt", false), 404)
+	t.expectCode("Delete missing recursive", t.writable.Delete(dir+"missing/", true), 404)
+
+	t.expectCode("Delete non-empty directory", t.writable.Delete(dir+"tree/", false), 409)
+	t.expectContent(dir+"tree/sub/b.txt", "x")
+
+	err = t.writable.MakeDir(dir+"empty/", false)
+	if t.expectOk("MakeDir", err) {
+		t.expectOk("Delete empty directory", t.writable.Delete(dir+"empty/", false))
+	}
+
+	if t.expectOk("Delete recursive", t.writable.Delete(dir+"tree/", true)) {
+		_, err := t.backend.List(dir+"tree/", 1)
+		t.expectCode("List after Delete recursive", err, 404)
+	}
+
+	item, err := t.backend.List(dir, 1)
+	if t.expectOk("List after Delete", err) && len(item.Children) != 0 {
+		t.errorf("List after Delete: %d children left", len(item.Children))
+	}
+}
+
+func (t *tester) checkTransfer(dir string) {
+
+	copier := t.backend.(gemdrive.Copier)
+	mover := t.backend.(gemdrive.Mover)
+
+	err := t.writable.MakeDir(dir+"src/sub/", true)
+	if !t.expectOk("MakeDir", err) {
+		return
+	}
+
+	files := map[string]string{
+		"src/a.txt":     "a",
+		"src/sub/b.txt": "bb",
+		"other.txt":     "other",
+	}
+
+	for name, content := range files {
+		err := t.writable.Write(dir+name, strings.NewReader(content), 0, int64(len(content)), false, false)
+		if !t.expectOk("Write "+name, err) {
+			return
+		}
+	}
+
+	if t.expectOk("Copy file", copier.Copy(dir+"src/a.txt", dir+"a-copy.txt", false)) {
+		t.expectContent(dir+"src/a.txt", "a")
+		t.expectContent(dir+"a-copy.txt", "a")
+	}
+
+	if t.expectOk("Copy directory", copier.Copy(dir+"src/", dir+"src-copy/", false)) {
+		t.expectContent(dir+"src-copy/sub/b.txt", "bb")
+		t.expectContent(dir+"src/sub/b.txt", "bb")
+	}
+
+	err = copier.Copy(dir+"other.txt", dir+"a-copy.txt", false)
+	t.expectCode("Copy onto existing", err, 409)
+	t.expectContent(dir+"a-copy.txt", "a")
+
+	err = copier.Copy(dir+"other.txt", dir+"a-copy.txt", true)
+	if t.expectOk("Copy with overwrite", err) {
+		t.expectContent(dir+"a-copy.txt", "other")
+	}
+
+	t.expectCode("Copy missing", copier.Copy(dir+"missing.txt", dir+"x.txt", false), 404)
+	t.expectCode("Copy into itself", copier.Copy(dir+"src/", dir+"src/sub/src/", false), 400)
+
+	if t.expectOk("Move file", mover.Move(dir+"a-copy.txt", dir+"moved.txt", false)) {
+		t.expectContent(dir+"moved.txt", "other")
+		_, _, err := t.read(dir+"a-copy.txt", 0, 0)
+		t.expectCode("Read after Move", err, 404)
+	}
+
+	if t.expectOk("Move directory", mover.Move(dir+"src-copy/", dir+"src-moved/", false)) {
+		t.expectContent(dir+"src-moved/sub/b.txt", "bb")
+		_, err := t.backend.List(dir+"src-copy/", 1)
+		t.expectCode("List after Move", err, 404)
+	}
+
+	err = mover.Move(dir+"other.txt", dir+"moved.txt", false)
+	t.expectCode("Move onto existing", err, 409)
+
+	t.expectCode("Move missing", mover.Move(dir+"missing.txt", dir+"x.txt", false), 404)
+	t.expectCode("Move into itself", mover.Move(dir+"src/", dir+"src/sub/src/", false), 400)
+	t.expectContent(dir+"src/sub/b.txt", "bb")
+}
+
+func expectNames(t *tester, what string, item *gemdrive.Item, names ...string) {
+	actual := []string{}
+	for name := range item.Children {
+		actual = append(actual, name)
+	}
+	sort.Strings(actual)
+
+	if strings.Join(actual, " ") != strings.Join(names, " ") {
+		t.errorf("%s: expected children %v, got %v", what, names, actual)
+	}
+}
+
+func walk(item *gemdrive.Item, names ...string) *gemdrive.Item {
+	for _, name := range names {
+		if item == nil {
+			return nil
+		}
+		item = item.Children[name]
+	}
+	return item
+}
+
+func dirPath(p string) string {
+	if !strings.HasSuffix(p, "/") {
+		return p + "/"
+	}
+	return p
+}
@@ -4,5 +4,11 @@ go 1.15
 
 require (
 	github.com/anderspitman/treemess-go v0.0.0-20210313015619-ba255d9f1e0f
+	github.com/coreos/go-oidc/v3 v3.0.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4
+	golang.org/x/oauth2 v0.0.0-20210313182246-cd4f82c27b84
 )
@@ -0,0 +1,38 @@
+package gemdrive
+
+import (
+	"fmt"
+	"strings"
+)
+
+// addHashes fills in the hashes of all the files in a listing. dirPath is
+// the path the listing came from.
+func addHashes(hasher Hasher, dirPath string, item *Item, algorithm string) error {
+
+	for name, child := range item.Children {
+		childPath := dirPath + name
+
+		if strings.HasSuffix(name, "/") {
+			err := addHashes(hasher, childPath, child, algorithm)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		hash, err := hasher.GetHash(childPath, algorithm)
+		if e, ok := err.(*Error); ok && e.HttpCode == 400 {
+			return err
+		} else if err != nil {
+			// Most likely deleted since it was listed
+			fmt.Println("Failed to hash", childPath, err)
+			continue
+		}
+
+		child.Hashes = map[string]string{
+			algorithm: hash,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package gemdrive
+
+import (
+	"os"
+	"sync"
+)
+
+// JsonStore keeps everything in a single JSON file. Simple and easy to
+// inspect, but the whole file is rewritten on every change.
+type JsonStore struct {
+	path  string
+	data  *StoreData
+	mutex sync.Mutex
+}
+
+var (
+	_ Store = (*JsonStore)(nil)
+)
+
+func NewJsonStore(path string) *JsonStore {
+	return &JsonStore{
+		path: path,
+	}
+}
+
+func (s *JsonStore) Load() (*StoreData, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data := &StoreData{}
+
+	err := loadJson(data, s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if data.Keys == nil {
+		data.Keys = make(map[string]*KeyData)
+	}
+	if data.Users == nil {
+		data.Users = make(map[string]*UserData)
+	}
+
+	s.data = data
+
+	return copyStoreData(data), nil
+}
+
+func (s *JsonStore) Commit(changes *StoreChanges) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data == nil {
+		return os.ErrInvalid
+	}
+
+	data := copyStoreData(s.data)
+	applyStoreChanges(data, changes)
+
+	err := saveJson(data, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.data = data
+
+	return nil
+}
+
+func (s *JsonStore) Close() error {
+	return nil
+}
+
+// Only the maps are copied. KeyData and UserData are never modified once
+// stored, so they can be shared.
+func copyStoreData(data *StoreData) *StoreData {
+	c := &StoreData{
+		Version: data.Version,
+		Keys:    make(map[string]*KeyData, len(data.Keys)),
+		Users:   make(map[string]*UserData, len(data.Users)),
+	}
+
+	for id, keyData := range data.Keys {
+		c.Keys[id] = keyData
+	}
+	for username, userData := range data.Users {
+		c.Users[username] = userData
+	}
+
+	return c
+}
+
+func applyStoreChanges(data *StoreData, changes *StoreChanges) {
+	if changes.Version != 0 {
+		data.Version = changes.Version
+	}
+	for _, id := range changes.DeleteKeys {
+		delete(data.Keys, id)
+	}
+	for id, keyData := range changes.PutKeys {
+		data.Keys[id] = keyData
+	}
+	for _, username := range changes.DeleteUsers {
+		delete(data.Users, username)
+	}
+	for username, userData := range changes.PutUsers {
+		data.Users[username] = userData
+	}
+}
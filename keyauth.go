@@ -2,80 +2,198 @@ package gemdrive
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"math/big"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+// ExpiresAt and NotBefore are RFC3339 timestamps. A MaxUses of 0 means the
+// key can be used any number of times. Session is set on keys created by
+// logging in. Bare keys are ones from before keys had IDs in them. They're
+// found by checking them against every bare key's hash, and no new ones can
+// be created.
 type KeyData struct {
 	Parent     string            `json:"parent"`
 	Privileges map[string]string `json:"privileges"`
+	ExpiresAt  string            `json:"expiresAt,omitempty"`
+	NotBefore  string            `json:"notBefore,omitempty"`
+	MaxUses    int               `json:"maxUses,omitempty"`
+	Uses       int               `json:"uses,omitempty"`
+	Salt       string            `json:"salt,omitempty"`
+	Hash       string            `json:"hash,omitempty"`
+	Session    bool              `json:"session,omitempty"`
+	Bare       bool              `json:"bare,omitempty"`
 }
 
-func (k KeyData) CanRead(pathStr string) bool {
-	for path, perm := range k.Privileges {
-		isSubpath := strings.HasPrefix(pathStr, path)
-		if isSubpath && permCanRead(perm) {
-			return true
-		}
+// Keys are handed out as "<id>.<secret>". The ID is random and unrelated to
+// the secret, so it can be shown in listings and logs. Only a salted hash of
+// the whole key is stored, under the ID.
+const keyIdLength = 16
+
+func genKey() (string, error) {
+	id, err := genRandomString(keyIdLength)
+	if err != nil {
+		return "", err
 	}
-	return false
+
+	secret, err := genRandomKey()
+	if err != nil {
+		return "", err
+	}
+
+	return id + "." + secret, nil
 }
-func (k KeyData) CanWrite(pathStr string) bool {
-	for path, perm := range k.Privileges {
-		isSubpath := strings.HasPrefix(pathStr, path)
-		if isSubpath && permCanWrite(perm) {
-			return true
+
+// splitKeyId returns the ID a key carries, if it has one.
+func splitKeyId(key string) (string, bool) {
+	i := strings.Index(key, ".")
+	if i <= 0 {
+		return "", false
+	}
+
+	id := key[:i]
+	for _, c := range id {
+		if !strings.ContainsRune(randomKeyChars, c) {
+			return "", false
 		}
 	}
-	return false
+
+	return id, true
+}
+
+func hashKey(key string) (string, string, error) {
+	saltBytes := make([]byte, 16)
+	_, err := rand.Read(saltBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	salt := hex.EncodeToString(saltBytes)
+
+	return salt, saltedHash(salt, key), nil
+}
+
+func saltedHash(salt, key string) string {
+	hash := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (k KeyData) matchesKey(key string) bool {
+	if k.Hash == "" {
+		return false
+	}
+
+	hash := saltedHash(k.Salt, key)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) == 1
+}
+
+// Redacted returns a copy with the key hash removed, for showing to users.
+func (k KeyData) Redacted() *KeyData {
+	k.Salt = ""
+	k.Hash = ""
+	return &k
 }
-func (k KeyData) IsSubsetOf(other *KeyData) bool {
-	for thisPath, thisPerm := range k.Privileges {
-		if !k.coveredBy(thisPath, thisPerm, other) {
+
+// IsValid checks the key's validity period. The usage limit is checked
+// when a request starts, by GemDriveDatabase.UseKey, since by the time the
+// request checks the key its own use has already been counted.
+func (k KeyData) IsValid() bool {
+	now := time.Now()
+
+	if k.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, k.NotBefore)
+		if err != nil || now.Before(notBefore) {
 			return false
 		}
 	}
-	return true
+
+	return !k.isPastExpiration(now)
 }
-func (k KeyData) coveredBy(path, perm string, other *KeyData) bool {
-	for otherPath, otherPerm := range other.Privileges {
-		isSubpath := strings.HasPrefix(path, otherPath)
-		if !isSubpath {
-			continue
-		}
 
-		if perm == "read" && permCanRead(otherPerm) {
-			return true
-		}
+// IsExpired reports whether the key can never become valid again.
+func (k KeyData) IsExpired(now time.Time) bool {
+	return k.isPastExpiration(now) || k.isUsedUp()
+}
 
-		if perm == "write" && permCanWrite(otherPerm) {
+func (k KeyData) isPastExpiration(now time.Time) bool {
+	if k.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, k.ExpiresAt)
+		if err != nil || !now.Before(expiresAt) {
 			return true
 		}
 	}
+
 	return false
 }
 
+func (k KeyData) isUsedUp() bool {
+	return k.MaxUses > 0 && k.Uses >= k.MaxUses
+}
+
 type Privilege struct {
 	Path string `json:"path"`
 	Perm string `json:"perm"`
 }
 
 type KeyAuth struct {
-	db *GemDriveDatabase
+	db            *GemDriveDatabase
+	signingSecret []byte
 }
 
-func NewKeyAuth(db *GemDriveDatabase) (*KeyAuth, error) {
+func NewKeyAuth(db *GemDriveDatabase, dataDir string) (*KeyAuth, error) {
+
+	signingSecret, err := loadSigningSecret(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
 	return &KeyAuth{
-		db: db,
+		db:            db,
+		signingSecret: signingSecret,
 	}, nil
 }
 
-func (a *KeyAuth) CanRead(key, pathStr string) bool {
+// keyData looks up the data for a key that's currently valid. Signed tokens
+// get the privileges of the key that signed them, limited to the signed path
+// and to what the signed method needs.
+func (a *KeyAuth) keyData(key, pathStr string) (*KeyData, error) {
+
+	if isSignedToken(key) {
+		u, keyData, err := a.verifySigned(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.TrimSuffix(pathStr, "/") != strings.TrimSuffix(u.Path, "/") {
+			return nil, errors.New("Signed URL is for a different path")
+		}
+
+		return keyData.limitedTo(methodPerms(u.Method)), nil
+	}
 
 	keyData, err := a.db.GetKeyData(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !keyData.IsValid() {
+		return nil, errors.New("Key is not valid")
+	}
+
+	return keyData, nil
+}
+
+func (a *KeyAuth) CanRead(key, pathStr string) bool {
+
+	keyData, err := a.keyData(key, pathStr)
 	if err != nil {
 		return false
 	}
@@ -85,7 +203,7 @@ func (a *KeyAuth) CanRead(key, pathStr string) bool {
 
 func (a *KeyAuth) CanWrite(key, pathStr string) bool {
 
-	keyData, err := a.db.GetKeyData(key)
+	keyData, err := a.keyData(key, pathStr)
 	if err != nil {
 		return false
 	}
@@ -93,31 +211,107 @@ func (a *KeyAuth) CanWrite(key, pathStr string) bool {
 	return keyData.CanWrite(pathStr)
 }
 
+// Can checks for a comma-separated list of permissions, e.g. "create,delete".
+func (a *KeyAuth) Can(key, pathStr, perm string) bool {
+
+	keyData, err := a.keyData(key, pathStr)
+	if err != nil {
+		return false
+	}
+
+	return keyData.Can(pathStr, perm)
+}
+
+func (a *KeyAuth) CanRecursive(key, pathStr, perm string) bool {
+
+	keyData, err := a.keyData(key, pathStr)
+	if err != nil {
+		return false
+	}
+
+	return keyData.CanRecursive(pathStr, perm)
+}
+
+func (a *KeyAuth) CanAccess(key, pathStr string) bool {
+
+	keyData, err := a.keyData(key, pathStr)
+	if err != nil {
+		return false
+	}
+
+	return keyData.CanAccess(pathStr)
+}
+
+// ReserveUse counts a request made with the key before it's served, and
+// reports whether the key had a use left. Requests made with a signed URL
+// count against the key that signed it, so a key can't get around its
+// limit by signing URLs.
+func (a *KeyAuth) ReserveUse(key string) bool {
+
+	if isSignedToken(key) {
+		u, _, err := a.verifySigned(key)
+		if err != nil {
+			return false
+		}
+
+		return a.db.UseKeyId(u.KeyId)
+	}
+
+	return a.db.UseKey(key)
+}
+
+// saveJson writes to a temporary file and renames it into place, so a crash
+// part way through leaves the old file intact rather than a truncated one.
 func saveJson(data interface{}, filePath string) error {
 	jsonStr, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		return errors.New("Error serializing JSON")
-	} else {
-		err := ioutil.WriteFile(filePath, jsonStr, 0644)
-		if err != nil {
-			return errors.New("Error saving JSON")
-		}
 	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return errors.New("Error saving JSON")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(jsonStr)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filePath)
+	}
+	if err != nil {
+		return errors.New("Error saving JSON")
+	}
+
 	return nil
 }
 
-func permCanRead(perm string) bool {
-	return perm == "read" || permCanWrite(perm)
+func loadJson(data interface{}, filePath string) error {
+	jsonBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonBytes, data)
 }
 
-func permCanWrite(perm string) bool {
-	return perm == "write"
-}
+const randomKeyChars string = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func genRandomKey() (string, error) {
-	const chars string = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	return genRandomString(32)
+}
+
+func genRandomString(length int) (string, error) {
+	chars := randomKeyChars
 	id := ""
-	for i := 0; i < 32; i++ {
+	for i := 0; i < length; i++ {
 		randIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
 		if err != nil {
 			return "", err
@@ -126,3 +320,17 @@ func genRandomKey() (string, error) {
 	}
 	return id, nil
 }
+
+// Checks that a string could have come from genRandomKey, so it's safe to
+// use in file paths.
+func isRandomKey(key string) bool {
+	if len(key) != 32 {
+		return false
+	}
+	for _, c := range key {
+		if !strings.ContainsRune(randomKeyChars, c) {
+			return false
+		}
+	}
+	return true
+}
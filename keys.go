@@ -0,0 +1,117 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Keys are only ever shown by ID, along with their data. The keys
+// themselves aren't stored, so they can't be shown.
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	key, _ := extractToken(r)
+
+	if key == "" {
+		key = "public"
+	}
+
+	keyId, err := s.db.GetKeyId(key)
+	if err != nil {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	keys := make(map[string]*KeyData)
+	for id, keyData := range s.db.GetDescendants(keyId) {
+		keys[id] = keyData.Redacted()
+	}
+
+	jsonBody, err := json.Marshal(keys)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+// A key can be inspected by itself or by any of its ancestors.
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request, targetId string) {
+	key, _ := extractToken(r)
+
+	if key == "" {
+		key = "public"
+	}
+
+	if !s.canManageKey(key, targetId) {
+		w.WriteHeader(404)
+		io.WriteString(w, "No such key")
+		return
+	}
+
+	keyData, err := s.db.GetKeyDataById(targetId)
+	if err != nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "No such key")
+		return
+	}
+
+	jsonBody, err := json.Marshal(keyData.Redacted())
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+// Revoking a key also revokes every key it created, directly or indirectly.
+func (s *Server) revokeKey(w http.ResponseWriter, r *http.Request, targetId string) {
+	key, _ := extractToken(r)
+
+	if key == "" {
+		key = "public"
+	}
+
+	if !s.canManageKey(key, targetId) {
+		w.WriteHeader(404)
+		io.WriteString(w, "No such key")
+		return
+	}
+
+	masterKeyId, err := s.db.GetMasterKeyId()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if targetId == masterKeyId || targetId == "public" {
+		w.WriteHeader(400)
+		io.WriteString(w, "This key can't be revoked")
+		return
+	}
+
+	err = s.db.DeleteKeyTree(targetId)
+	if err != nil {
+		w.WriteHeader(404)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+// Unknown keys and keys the caller has no say over are treated the same, so
+// as not to reveal which keys exist.
+func (s *Server) canManageKey(key, targetId string) bool {
+	id, err := s.db.GetKeyId(key)
+	if err != nil {
+		return false
+	}
+
+	return id == targetId || s.db.IsDescendant(targetId, id)
+}
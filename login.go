@@ -0,0 +1,246 @@
+package gemdrive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Logging in creates a session key that expires after sessionLifetime, and
+// stores it in an HttpOnly cookie. Since browsers send cookies along with
+// cross-site requests, writes authenticated by the cookie also need an
+// X-CSRF-Token header matching the csrf_token cookie, which only pages on
+// this site can read.
+
+const sessionLifetime = 7 * 24 * time.Hour
+
+const csrfCookieName = "csrf_token"
+const csrfHeaderName = "X-CSRF-Token"
+
+// Compared against when the user doesn't exist, so that takes as long as a
+// wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("gemdrive"), bcrypt.DefaultCost)
+
+const loginPageHtml = `<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>GemDrive Login</title>
+  </head>
+  <body>
+    <h1>GemDrive Login</h1>
+    <form method="POST" action="/gemdrive/login">
+      <input type="hidden" id="redirect" name="redirect" value="/">
+      <p><input type="text" name="username" placeholder="Username" autocomplete="username" required></p>
+      <p><input type="password" name="password" placeholder="Password" autocomplete="current-password" required></p>
+      <p><button type="submit">Log in</button></p>
+    </form>
+    <!-- oidc -->
+    <script>
+      const params = new URLSearchParams(location.search);
+      const redirect = location.pathname === '/gemdrive/login' ?
+        (params.get('redirect') || '/') : location.pathname + location.search;
+      document.getElementById('redirect').value = redirect;
+      const sso = document.getElementById('sso');
+      if (sso) {
+        sso.href += '?redirect=' + encodeURIComponent(redirect);
+      }
+    </script>
+  </body>
+</html>
+`
+
+const oidcLoginHtml = `<p><a id="sso" href="/gemdrive/oidc/login">Log in with single sign-on</a></p>`
+
+// CsrfToken returns the CSRF token that goes with a session key.
+func (a *KeyAuth) CsrfToken(key string) string {
+	mac := hmac.New(sha256.New, a.signingSecret)
+	mac.Write([]byte("csrf:" + key))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Only the cookie is sent automatically by browsers, so it's the only token
+// source that needs CSRF protection.
+func tokenFromCookie(r *http.Request) bool {
+	if r.URL.Query().Get("access_token") != "" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	_, err := r.Cookie("access_token")
+	return err == nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return true
+	}
+	return false
+}
+
+func (s *Server) checkCsrf(w http.ResponseWriter, r *http.Request, token string) bool {
+
+	if isSafeMethod(r.Method) || !tokenFromCookie(r) {
+		return true
+	}
+
+	csrfToken := r.Header.Get(csrfHeaderName)
+
+	if !hmac.Equal([]byte(csrfToken), []byte(s.keyAuth.CsrfToken(token))) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Missing or invalid CSRF token")
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) serveLoginPage(w http.ResponseWriter, r *http.Request, code int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(s.loginHtml)
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	password := r.PostForm.Get("password")
+
+	userData, err := s.db.GetUser(username)
+
+	passwordHash := dummyPasswordHash
+	if err == nil {
+		passwordHash = []byte(userData.PasswordHash)
+	}
+
+	err = bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
+	if err != nil || userData == nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "Invalid username or password")
+		return
+	}
+
+	userKeyData, err := s.db.GetKeyDataById(userData.KeyId)
+	if err != nil || !userKeyData.IsValid() {
+		w.WriteHeader(401)
+		io.WriteString(w, "Invalid username or password")
+		return
+	}
+
+	privileges := make(map[string]string)
+	for pattern, perm := range userKeyData.Privileges {
+		privileges[pattern] = perm
+	}
+
+	sessionKeyData := &KeyData{
+		Parent:     userData.KeyId,
+		Privileges: privileges,
+		ExpiresAt:  userKeyData.ExpiresAt,
+		NotBefore:  userKeyData.NotBefore,
+	}
+
+	s.startSession(w, r, sessionKeyData, r.PostForm.Get("redirect"))
+}
+
+// startSession creates a session key, sets the cookies for it and redirects
+// back into the site. The session expires after sessionLifetime, or when
+// keyData says, whichever comes first.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, keyData *KeyData, redirect string) {
+
+	expiresAt := time.Now().Add(sessionLifetime)
+
+	if keyData.ExpiresAt != "" {
+		keyExpiresAt, _ := time.Parse(time.RFC3339, keyData.ExpiresAt)
+		if keyExpiresAt.Before(expiresAt) {
+			expiresAt = keyExpiresAt
+		}
+	}
+
+	keyData.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	keyData.Session = true
+
+	sessionKey, err := genKey()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	_, err = s.db.SetKeyData(sessionKey, keyData)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    sessionKey,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    s.keyAuth.CsrfToken(sessionKey),
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, localRedirect(redirect), 303)
+}
+
+// localRedirect only allows redirecting within this site.
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.Contains(redirect, "\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// logout revokes the session key and clears the cookies. It's subject to the
+// CSRF check like any other cookie-authenticated POST.
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+
+	tokenCookie, err := r.Cookie("access_token")
+	if err == nil {
+		id, err := s.db.GetKeyId(tokenCookie.Value)
+		if err == nil {
+			keyData, err := s.db.GetKeyDataById(id)
+			if err == nil && keyData.Session {
+				s.db.DeleteKeyTree(id)
+			}
+		}
+	}
+
+	for _, name := range []string{"access_token", csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+			Secure: true,
+		})
+	}
+
+	http.Redirect(w, r, "/gemdrive/login", 303)
+}
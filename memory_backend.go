@@ -0,0 +1,540 @@
+package gemdrive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// MemoryBackend keeps everything in memory, for tests and for scratch space
+// that doesn't need to survive a restart.
+type MemoryBackend struct {
+	mut  sync.RWMutex
+	root *memNode
+	// Total bytes of file data, and the most there can be. 0 means no limit.
+	size    int64
+	maxSize int64
+}
+
+type memNode struct {
+	isDir        bool
+	data         []byte
+	modTime      time.Time
+	isExecutable bool
+	children     map[string]*memNode
+	// Thumbnails by size, dropped whenever the data changes
+	images map[int][]byte
+}
+
+// NewMemoryBackend takes the most file data it can hold in bytes, or 0 for
+// no limit. Writes and copies that would go over it fail with 413.
+func NewMemoryBackend(maxSize int64) *MemoryBackend {
+	return &MemoryBackend{
+		root:    newMemDir(),
+		maxSize: maxSize,
+	}
+}
+
+var errMemoryFull = &Error{HttpCode: 413, Message: "Memory backend is full"}
+
+func newMemDir() *memNode {
+	return &memNode{
+		isDir:    true,
+		modTime:  time.Now(),
+		children: make(map[string]*memNode),
+	}
+}
+
+func (n *memNode) item() *Item {
+	item := &Item{
+		ModTime: n.modTime.UTC().Format(time.RFC3339Nano),
+	}
+
+	if !n.isDir {
+		item.Size = int64(len(n.data))
+		item.IsExecutable = n.isExecutable
+	}
+
+	return item
+}
+
+// dataSize returns the bytes of file data in n and everything under it.
+func (n *memNode) dataSize() int64 {
+	if !n.isDir {
+		return int64(len(n.data))
+	}
+
+	var size int64
+	for _, child := range n.children {
+		size += child.dataSize()
+	}
+	return size
+}
+
+func (n *memNode) copy() *memNode {
+	c := *n
+	c.images = nil
+
+	if n.isDir {
+		c.children = make(map[string]*memNode)
+		for name, child := range n.children {
+			c.children[name] = child.copy()
+		}
+	} else {
+		c.data = append([]byte(nil), n.data...)
+	}
+
+	return &c
+}
+
+func splitMemPath(reqPath string) []string {
+	cleaned := strings.Trim(path.Clean("/"+reqPath), "/")
+	if cleaned == "" {
+		return []string{}
+	}
+	return strings.Split(cleaned, "/")
+}
+
+// lookup returns the node at reqPath, or nil if there isn't one.
+func (b *MemoryBackend) lookup(reqPath string) *memNode {
+	node := b.root
+
+	for _, name := range splitMemPath(reqPath) {
+		if !node.isDir {
+			return nil
+		}
+
+		node = node.children[name]
+		if node == nil {
+			return nil
+		}
+	}
+
+	return node
+}
+
+// lookupParent returns the directory that contains reqPath, along with the
+// name of the item in it.
+func (b *MemoryBackend) lookupParent(reqPath string) (*memNode, string, error) {
+	parts := splitMemPath(reqPath)
+	if len(parts) == 0 {
+		return nil, "", &Error{HttpCode: 400, Message: "Invalid path"}
+	}
+
+	parent := b.lookup(strings.Join(parts[:len(parts)-1], "/"))
+	if parent == nil {
+		return nil, "", &Error{HttpCode: 404, Message: "Parent directory not found"}
+	}
+
+	if !parent.isDir {
+		return nil, "", &Error{HttpCode: 409, Message: "Parent is not a directory"}
+	}
+
+	return parent, parts[len(parts)-1], nil
+}
+
+func (b *MemoryBackend) List(reqPath string, depth int) (*Item, error) {
+
+	maxAllowedDepth := 10
+
+	if depth > maxAllowedDepth {
+		errMsg := fmt.Sprintf("max-depth is greater than allowed value (%d)", maxAllowedDepth)
+		return nil, &Error{HttpCode: 400, Message: errMsg}
+	}
+
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	node := b.lookup(reqPath)
+	if node == nil {
+		return nil, &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	if !node.isDir {
+		return nil, &Error{HttpCode: 400, Message: "Not a directory"}
+	}
+
+	return listMemDir(node, depth), nil
+}
+
+// A depth of 0 means no limit.
+func listMemDir(node *memNode, depth int) *Item {
+	item := node.item()
+
+	if len(node.children) > 0 {
+		item.Children = make(map[string]*Item)
+	}
+
+	for name, child := range node.children {
+		if !child.isDir {
+			item.Children[name] = child.item()
+		} else if depth == 1 {
+			item.Children[name+"/"] = child.item()
+		} else {
+			childDepth := 0
+			if depth > 1 {
+				childDepth = depth - 1
+			}
+			item.Children[name+"/"] = listMemDir(child, childDepth)
+		}
+	}
+
+	return item
+}
+
+func (b *MemoryBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	node := b.lookup(reqPath)
+	if node == nil {
+		return nil, nil, &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	if node.isDir {
+		return nil, nil, &Error{HttpCode: 400, Message: "Is a directory"}
+	}
+
+	size := int64(len(node.data))
+
+	if offset < 0 || offset > size || length < 0 {
+		return nil, nil, &Error{HttpCode: 416, Message: "Invalid range"}
+	}
+
+	end := size
+	if length != 0 && offset+length < size {
+		end = offset + length
+	}
+
+	// Copied so later writes don't change what's being read
+	data := append([]byte(nil), node.data[offset:end]...)
+
+	return node.item(), ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *MemoryBackend) MakeDir(reqPath string, recursive bool) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if !recursive {
+		parent, name, err := b.lookupParent(reqPath)
+		if err != nil {
+			return err
+		}
+
+		if _, exists := parent.children[name]; exists {
+			return &Error{HttpCode: 409, Message: "Directory exists"}
+		}
+
+		parent.children[name] = newMemDir()
+		parent.modTime = time.Now()
+
+		return nil
+	}
+
+	node := b.root
+	for _, name := range splitMemPath(reqPath) {
+		child, exists := node.children[name]
+		if !exists {
+			child = newMemDir()
+			node.children[name] = child
+			node.modTime = time.Now()
+		} else if !child.isDir {
+			return &Error{HttpCode: 409, Message: "Not a directory"}
+		}
+
+		node = child
+	}
+
+	return nil
+}
+
+// A negative length means the length isn't known in advance.
+func (b *MemoryBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+
+	if b.maxSize > 0 {
+		if length > b.maxSize {
+			return errMemoryFull
+		}
+		data = io.LimitReader(data, b.maxSize+1)
+	}
+
+	// Read everything before taking the lock, since it may be coming over
+	// the network.
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	if b.maxSize > 0 && int64(len(buf)) > b.maxSize {
+		return errMemoryFull
+	}
+
+	if length >= 0 && int64(len(buf)) != length {
+		return &Error{HttpCode: 400, Message: "n did not match length"}
+	}
+
+	if offset < 0 {
+		return &Error{HttpCode: 400, Message: "Invalid offset"}
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	parent, name, err := b.lookupParent(reqPath)
+	if err != nil {
+		return err
+	}
+
+	node, exists := parent.children[name]
+	if exists {
+		if !overwrite {
+			return &Error{HttpCode: 409, Message: "File exists"}
+		}
+
+		if node.isDir {
+			return &Error{HttpCode: 409, Message: "Is a directory"}
+		}
+	} else {
+		node = &memNode{}
+	}
+
+	oldSize := int64(len(node.data))
+	newSize := oldSize
+	if truncate {
+		newSize = 0
+	}
+	end := offset + int64(len(buf))
+	if end > newSize {
+		newSize = end
+	}
+
+	if b.maxSize > 0 && b.size-oldSize+newSize > b.maxSize {
+		return errMemoryFull
+	}
+
+	if !exists {
+		parent.children[name] = node
+		parent.modTime = time.Now()
+	}
+
+	if truncate {
+		node.data = nil
+	}
+
+	if end > int64(len(node.data)) {
+		grown := make([]byte, end)
+		copy(grown, node.data)
+		node.data = grown
+	}
+
+	copy(node.data[offset:], buf)
+	node.modTime = time.Now()
+	node.images = nil
+
+	b.size += newSize - oldSize
+
+	return nil
+}
+
+func (b *MemoryBackend) SetAttributes(reqPath string, modTime time.Time, isExecutable bool) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	node := b.lookup(reqPath)
+	if node == nil {
+		return &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	node.modTime = modTime
+
+	if !node.isDir {
+		node.isExecutable = isExecutable
+	}
+
+	return nil
+}
+
+func (b *MemoryBackend) Delete(reqPath string, recursive bool) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	parent, name, err := b.lookupParent(reqPath)
+	if err != nil {
+		return err
+	}
+
+	node, exists := parent.children[name]
+	if !exists {
+		return &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	if node.isDir && len(node.children) > 0 && !recursive {
+		return &Error{HttpCode: 409, Message: "Directory not empty"}
+	}
+
+	delete(parent.children, name)
+	parent.modTime = time.Now()
+
+	b.size -= node.dataSize()
+
+	return nil
+}
+
+func (b *MemoryBackend) Move(srcPath, dstPath string, overwrite bool) error {
+	return b.transfer(srcPath, dstPath, overwrite, true)
+}
+
+func (b *MemoryBackend) Copy(srcPath, dstPath string, overwrite bool) error {
+	return b.transfer(srcPath, dstPath, overwrite, false)
+}
+
+func (b *MemoryBackend) transfer(srcPath, dstPath string, overwrite, move bool) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	srcParent, srcName, err := b.lookupParent(srcPath)
+	if err != nil {
+		return &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	node, exists := srcParent.children[srcName]
+	if !exists {
+		return &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	src := "/" + strings.Join(splitMemPath(srcPath), "/")
+	dst := "/" + strings.Join(splitMemPath(dstPath), "/")
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return &Error{HttpCode: 400, Message: "Can't move or copy a directory into itself"}
+	}
+
+	dstParent, dstName, err := b.lookupParent(dstPath)
+	if err != nil {
+		return err
+	}
+
+	var replacedSize int64
+	if replaced, exists := dstParent.children[dstName]; exists {
+		if !overwrite {
+			return &Error{HttpCode: 409, Message: "Destination exists"}
+		}
+		replacedSize = replaced.dataSize()
+	}
+
+	var addedSize int64
+	if !move {
+		addedSize = node.dataSize()
+	}
+
+	if b.maxSize > 0 && b.size+addedSize-replacedSize > b.maxSize {
+		return errMemoryFull
+	}
+
+	if move {
+		delete(srcParent.children, srcName)
+		srcParent.modTime = time.Now()
+	} else {
+		node = node.copy()
+	}
+
+	dstParent.children[dstName] = node
+	dstParent.modTime = time.Now()
+
+	b.size += addedSize - replacedSize
+
+	return nil
+}
+
+func (b *MemoryBackend) GetImage(reqPath string, size int) (io.Reader, int64, error) {
+
+	b.mut.RLock()
+	node := b.lookup(reqPath)
+	if node == nil || node.isDir {
+		b.mut.RUnlock()
+		return nil, 0, &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	cached, exists := node.images[size]
+	data := append([]byte(nil), node.data...)
+	b.mut.RUnlock()
+
+	if exists {
+		return bytes.NewReader(cached), int64(len(cached)), nil
+	}
+
+	img, err := decodeImage(reqPath, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Max.X
+	height := bounds.Max.Y
+
+	resizeWidth := uint(size)
+	resizeHeight := uint(size)
+	if width > height {
+		resizeHeight = 0
+	} else {
+		resizeWidth = 0
+	}
+
+	m := resize.Resize(resizeWidth, resizeHeight, img, resize.Lanczos3)
+
+	var out bytes.Buffer
+	err = encodeImage(reqPath, &out, m)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.mut.Lock()
+	if node.images == nil {
+		node.images = make(map[int][]byte)
+	}
+	node.images[size] = out.Bytes()
+	b.mut.Unlock()
+
+	return bytes.NewReader(out.Bytes()), int64(out.Len()), nil
+}
+
+func (b *MemoryBackend) GetHash(reqPath string, algorithm string) (string, error) {
+
+	if algorithm != HashSha256 {
+		return "", &Error{HttpCode: 400, Message: "Unsupported hash algorithm"}
+	}
+
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	node := b.lookup(reqPath)
+	if node == nil {
+		return "", &Error{HttpCode: 404, Message: "Not found"}
+	}
+
+	if node.isDir {
+		return "", &Error{HttpCode: 400, Message: "Can't hash a directory"}
+	}
+
+	hash := sha256.Sum256(node.data)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+var (
+	_ Backend         = (*MemoryBackend)(nil)
+	_ WritableBackend = (*MemoryBackend)(nil)
+	_ Mover           = (*MemoryBackend)(nil)
+	_ Copier          = (*MemoryBackend)(nil)
+	_ ImageServer     = (*MemoryBackend)(nil)
+	_ Hasher          = (*MemoryBackend)(nil)
+)
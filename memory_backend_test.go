@@ -0,0 +1,49 @@
+package gemdrive_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gemdrive/gemdrive-go"
+	"github.com/gemdrive/gemdrive-go/gemdrivetest"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	gemdrivetest.TestBackend(t, gemdrive.NewMemoryBackend(0), "/")
+}
+
+func TestMemoryBackendMaxSize(t *testing.T) {
+
+	backend := gemdrive.NewMemoryBackend(10)
+
+	expectFull := func(what string, err error) {
+		t.Helper()
+		if e, ok := err.(*gemdrive.Error); !ok || e.HttpCode != 413 {
+			t.Fatalf("%s: expected *Error with code 413, got %v", what, err)
+		}
+	}
+
+	err := backend.Write("/a.txt", strings.NewReader("123456"), 0, 6, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFull("Write past limit", backend.Write("/b.txt", strings.NewReader("12345"), 0, 5, false, false))
+	expectFull("Write unknown length past limit", backend.Write("/b.txt", strings.NewReader("12345678901"), 0, -1, false, false))
+	expectFull("Copy past limit", backend.Copy("/a.txt", "/c.txt", false))
+
+	err = backend.Write("/a.txt", strings.NewReader("1234567890"), 0, 10, true, true)
+	if err != nil {
+		t.Fatalf("Overwrite up to limit: %v", err)
+	}
+
+	err = backend.Delete("/a.txt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.Write("/b.txt", strings.NewReader("12345"), 0, 5, false, false)
+	if err != nil {
+		t.Fatalf("Write after Delete: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+func (s *Server) move(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+	key, _ := extractToken(r)
+
+	if key == "" {
+		key = "public"
+	}
+
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	reqData := &MoveRequest{}
+	err = json.Unmarshal(bodyJson, reqData)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if reqData.Source == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "move: Missing source")
+		return
+	}
+
+	if reqData.Destination == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "move: Missing destination")
+		return
+	}
+
+	// Unlike URL paths, these haven't been cleaned
+	if !isCanonicalPath(reqData.Source) || !isCanonicalPath(reqData.Destination) {
+		w.WriteHeader(400)
+		io.WriteString(w, "move: Invalid path")
+		return
+	}
+
+	srcPath := mappedRoot + reqData.Source
+	dstPath := mappedRoot + reqData.Destination
+
+	if !s.keyAuth.CanRecursive(key, srcPath, "delete") {
+		w.WriteHeader(403)
+		io.WriteString(w, "move: You don't have permission to write to "+reqData.Source)
+		return
+	}
+
+	dstPerm := writePerm(s.writeEventType(dstPath, reqData.Overwrite))
+
+	if !s.keyAuth.CanRecursive(key, dstPath, dstPerm) {
+		w.WriteHeader(403)
+		io.WriteString(w, "move: You don't have permission to write to "+reqData.Destination)
+		return
+	}
+
+	if _, ok := s.backend.(WritableBackend); !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "move: Backend does not support writing")
+		return
+	}
+
+	err = moveItem(s.backend, srcPath, dstPath, reqData.Overwrite)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, "move: "+e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, "move: "+err.Error())
+		return
+	}
+
+	s.emitRename(srcPath, dstPath)
+}
@@ -0,0 +1,51 @@
+package gemdrive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMoveRejectsTraversal(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	client, err := NewClient(baseUrl, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.MakeDir("/docs/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Write("/secret.txt", strings.NewReader("secret"), 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docsKey, err := client.CreateKey(&KeyData{
+		Privileges: map[string]string{
+			"/docs/": "write",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"source": "/docs/../secret.txt", "destination": "/docs/stolen.txt"}`,
+		`{"source": "/docs/a.txt", "destination": "/docs/../../outside.txt"}`,
+		`{"source": "docs/a.txt", "destination": "/docs/b.txt"}`,
+	} {
+		status, _ := doRequest(t, "POST", baseUrl+"/gemdrive/move", docsKey, body)
+		if status != 400 {
+			t.Errorf("%s: got %d, want 400", body, status)
+		}
+	}
+
+	status, body := doRequest(t, "GET", baseUrl+"/secret.txt", masterKey, "")
+	if status != 200 || body != "secret" {
+		t.Fatalf("Reading moved-from file: got %d %q", status, body)
+	}
+}
@@ -2,6 +2,7 @@ package gemdrive
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 	"sync"
@@ -9,8 +10,9 @@ import (
 )
 
 type MultiBackend struct {
-	backends map[string]Backend
-	mut      *sync.Mutex
+	backends      map[string]Backend
+	mut           *sync.Mutex
+	watchCallback func(*Event)
 }
 
 func NewMultiBackend() *MultiBackend {
@@ -26,6 +28,11 @@ func (b *MultiBackend) AddBackend(name string, backend Backend) error {
 	defer b.mut.Unlock()
 
 	b.backends[name] = backend
+
+	if b.watchCallback != nil {
+		b.watchChild(name, backend)
+	}
+
 	return nil
 }
 
@@ -49,6 +56,16 @@ func (b *MultiBackend) List(reqPath string, depth int) (*Item, error) {
 	b.mut.Unlock()
 
 	if reqPath == "/" {
+		maxAllowedDepth := 10
+
+		if depth > maxAllowedDepth {
+			errMsg := fmt.Sprintf("max-depth is greater than allowed value (%d)", maxAllowedDepth)
+			return nil, &Error{
+				HttpCode: 400,
+				Message:  errMsg,
+			}
+		}
+
 		rootItem := &Item{
 			Size:     4096,
 			ModTime:  time.Now().UTC().Format(time.RFC3339),
@@ -126,7 +143,10 @@ func (b *MultiBackend) MakeDir(reqPath string, recursive bool) error {
 		return backend.MakeDir(subPath, recursive)
 	}
 
-	return nil
+	return &Error{
+		HttpCode: 500,
+		Message:  "Backend does not support writing",
+	}
 }
 
 func (b *MultiBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
@@ -147,7 +167,10 @@ func (b *MultiBackend) Write(reqPath string, data io.Reader, offset, length int6
 		return backend.Write(subPath, data, offset, length, overwrite, truncate)
 	}
 
-	return nil
+	return &Error{
+		HttpCode: 500,
+		Message:  "Backend does not support writing",
+	}
 }
 
 func (b *MultiBackend) SetAttributes(reqPath string, modTime time.Time, isExecutable bool) error {
@@ -171,8 +194,6 @@ func (b *MultiBackend) SetAttributes(reqPath string, modTime time.Time, isExecut
 			Message:  "Backend does not support writing",
 		}
 	}
-
-	return nil
 }
 
 func (b *MultiBackend) Delete(reqPath string, recursive bool) error {
@@ -198,6 +219,49 @@ func (b *MultiBackend) Delete(reqPath string, recursive bool) error {
 	}
 }
 
+func (b *MultiBackend) Move(srcPath, dstPath string, overwrite bool) error {
+	return b.transfer(srcPath, dstPath, overwrite, true)
+}
+
+func (b *MultiBackend) Copy(srcPath, dstPath string, overwrite bool) error {
+	return b.transfer(srcPath, dstPath, overwrite, false)
+}
+
+// transfer implements Move and Copy. Within a single backend the operation
+// is delegated, otherwise the data is copied between backends.
+func (b *MultiBackend) transfer(srcPath, dstPath string, overwrite, move bool) error {
+
+	srcName, srcSubPath, err := b.parsePath(srcPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	dstName, dstSubPath, err := b.parsePath(dstPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	b.mut.Lock()
+	srcBackend := b.backends[srcName]
+	dstBackend := b.backends[dstName]
+	b.mut.Unlock()
+
+	if srcName == dstName {
+		if move {
+			return moveItem(srcBackend, srcSubPath, dstSubPath, overwrite)
+		}
+		return copyItem(srcBackend, srcSubPath, dstSubPath, overwrite)
+	}
+
+	return transferItem(srcBackend, srcSubPath, dstBackend, dstSubPath, overwrite, move)
+}
+
 func (b *MultiBackend) GetImage(reqPath string, size int) (io.Reader, int64, error) {
 
 	backendName, subPath, err := b.parsePath(reqPath)
@@ -219,10 +283,88 @@ func (b *MultiBackend) GetImage(reqPath string, size int) (io.Reader, int64, err
 	return nil, 0, errors.New("Backend does not support images")
 }
 
+func (b *MultiBackend) GetHash(reqPath string, algorithm string) (string, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return "", &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	b.mut.Lock()
+	backend := b.backends[backendName]
+	b.mut.Unlock()
+
+	if backend, ok := backend.(Hasher); ok {
+		return backend.GetHash(subPath, algorithm)
+	}
+
+	return "", &Error{
+		HttpCode: 501,
+		Message:  "Backend does not support hashing",
+	}
+}
+
+func (b *MultiBackend) GetCachedHash(reqPath string, algorithm string) (string, bool) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return "", false
+	}
+
+	b.mut.Lock()
+	backend := b.backends[backendName]
+	b.mut.Unlock()
+
+	if backend, ok := backend.(CachedHasher); ok {
+		return backend.GetCachedHash(subPath, algorithm)
+	}
+
+	return "", false
+}
+
+// Watch watches every child backend that supports it, including ones added
+// later.
+func (b *MultiBackend) Watch(callback func(*Event)) error {
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	b.watchCallback = callback
+
+	for name, backend := range b.backends {
+		b.watchChild(name, backend)
+	}
+
+	return nil
+}
+
+func (b *MultiBackend) watchChild(name string, backend Backend) {
+	watcher, ok := backend.(Watcher)
+	if !ok {
+		return
+	}
+
+	callback := b.watchCallback
+
+	err := watcher.Watch(func(event *Event) {
+		event.Path = "/" + name + event.Path
+		if event.OldPath != "" {
+			event.OldPath = "/" + name + event.OldPath
+		}
+		callback(event)
+	})
+	if err != nil {
+		fmt.Println("watch:", name, err)
+	}
+}
+
 func (b *MultiBackend) parsePath(reqPath string) (string, string, error) {
 	parts := strings.Split(reqPath, "/")
 
-	if len(parts) < 3 {
+	if len(parts) < 2 {
 		return "", "", errors.New("Invalid path")
 	}
 
@@ -244,5 +386,10 @@ func (b *MultiBackend) parsePath(reqPath string) (string, string, error) {
 var (
 	_ Backend         = (*MultiBackend)(nil)
 	_ WritableBackend = (*MultiBackend)(nil)
+	_ Mover           = (*MultiBackend)(nil)
+	_ Copier          = (*MultiBackend)(nil)
 	_ ImageServer     = (*MultiBackend)(nil)
+	_ Hasher          = (*MultiBackend)(nil)
+	_ CachedHasher    = (*MultiBackend)(nil)
+	_ Watcher         = (*MultiBackend)(nil)
 )
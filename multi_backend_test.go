@@ -0,0 +1,20 @@
+package gemdrive_test
+
+import (
+	"testing"
+
+	"github.com/gemdrive/gemdrive-go"
+	"github.com/gemdrive/gemdrive-go/gemdrivetest"
+)
+
+func TestMultiBackend(t *testing.T) {
+
+	backend := gemdrive.NewMultiBackend()
+
+	err := backend.AddBackend("scratch", gemdrive.NewMemoryBackend(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gemdrivetest.TestBackend(t, backend, "/scratch/")
+}
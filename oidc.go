@@ -0,0 +1,330 @@
+package gemdrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OpenID Connect login uses the authorization code flow with PKCE. The ID
+// token's claims are matched against the configured templates to decide
+// what the session key can do. Sessions are children of the master key.
+
+const oidcStateCookieName = "oidc_state"
+
+const oidcStateLifetime = 10 * time.Minute
+
+type oidcLogin struct {
+	config *OidcConfig
+
+	mut      sync.Mutex
+	provider *oidc.Provider
+}
+
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+}
+
+func newOidcLogin(config *OidcConfig) *oidcLogin {
+	return &oidcLogin{
+		config: config,
+	}
+}
+
+// Discovery happens on first use rather than at startup, so the server still
+// comes up if the provider is down.
+func (o *oidcLogin) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, o.config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	o.provider = provider
+
+	return provider, nil
+}
+
+func (o *oidcLogin) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := o.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     o.config.ClientId,
+		ClientSecret: o.config.ClientSecret,
+		RedirectURL:  o.config.RedirectUrl,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}
+}
+
+// privileges returns the combined privileges of every template that matches
+// the claims. Where two templates give the same path, the permissions are
+// added together.
+func (o *oidcLogin) privileges(claims map[string]interface{}) map[string]string {
+
+	// Providers that don't say an address is verified are taken not to
+	// have verified it.
+	email, _ := claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); !ok || !verified {
+		email = ""
+	}
+
+	groupsClaim := o.config.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	groups := make(map[string]bool)
+	switch claimGroups := claims[groupsClaim].(type) {
+	case string:
+		groups[claimGroups] = true
+	case []interface{}:
+		for _, g := range claimGroups {
+			if group, ok := g.(string); ok {
+				groups[group] = true
+			}
+		}
+	}
+
+	permsByPath := make(map[string]permSet)
+
+	for _, template := range o.config.Templates {
+		if template.Email != "" {
+			matched, err := path.Match(template.Email, email)
+			if email == "" || err != nil || !matched {
+				continue
+			}
+		}
+
+		if template.Group != "" && !groups[template.Group] {
+			continue
+		}
+
+		for pattern, perm := range template.Privileges {
+			if strings.Contains(pattern, "{email}") {
+				if email == "" {
+					continue
+				}
+				pattern = strings.ReplaceAll(pattern, "{email}", escapeGlob(email))
+			}
+
+			perms, ok := parsePerms(perm)
+			if !ok {
+				continue
+			}
+
+			permsByPath[pattern] |= perms
+		}
+	}
+
+	privileges := make(map[string]string)
+	for pattern, perms := range permsByPath {
+		privileges[pattern] = perms.String()
+	}
+
+	return privileges
+}
+
+// Claims come from the provider, but may still contain characters that would
+// otherwise be taken as globs in a privilege path.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+
+	provider, err := s.oidc.getProvider(r.Context())
+	if err != nil {
+		w.WriteHeader(502)
+		io.WriteString(w, "OIDC provider unavailable: "+err.Error())
+		return
+	}
+
+	state := &oidcState{
+		Redirect: localRedirect(r.URL.Query().Get("redirect")),
+	}
+
+	for _, value := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		*value, err = genRandomKey()
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(stateJson),
+		Path:     "/gemdrive/oidc/",
+		MaxAge:   int(oidcStateLifetime.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	authUrl := s.oidc.oauth2Config(provider).AuthCodeURL(state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	http.Redirect(w, r, authUrl, 302)
+}
+
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+
+	state, err := readOidcState(r)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookieName,
+		Value:  "",
+		Path:   "/gemdrive/oidc/",
+		MaxAge: -1,
+		Secure: true,
+	})
+
+	query := r.URL.Query()
+
+	if query.Get("error") != "" {
+		w.WriteHeader(401)
+		io.WriteString(w, "Login failed: "+query.Get("error"))
+		return
+	}
+
+	if query.Get("state") != state.State {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid state")
+		return
+	}
+
+	provider, err := s.oidc.getProvider(r.Context())
+	if err != nil {
+		w.WriteHeader(502)
+		io.WriteString(w, "OIDC provider unavailable: "+err.Error())
+		return
+	}
+
+	token, err := s.oidc.oauth2Config(provider).Exchange(r.Context(), query.Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", state.Verifier))
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "Exchanging code failed: "+err.Error())
+		return
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		w.WriteHeader(401)
+		io.WriteString(w, "No ID token in response")
+		return
+	}
+
+	verifier := provider.Verifier(&oidc.Config{ClientID: s.oidc.config.ClientId})
+
+	idToken, err := verifier.Verify(r.Context(), rawIdToken)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "Invalid ID token: "+err.Error())
+		return
+	}
+
+	if idToken.Nonce != state.Nonce {
+		w.WriteHeader(401)
+		io.WriteString(w, "Invalid nonce")
+		return
+	}
+
+	var claims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	privileges := s.oidc.privileges(claims)
+	if len(privileges) == 0 {
+		w.WriteHeader(403)
+		io.WriteString(w, "This account doesn't have access")
+		return
+	}
+
+	masterKeyId, err := s.db.GetMasterKeyId()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	sessionKeyData := &KeyData{
+		Parent:     masterKeyId,
+		Privileges: privileges,
+	}
+
+	s.startSession(w, r, sessionKeyData, state.Redirect)
+}
+
+func readOidcState(r *http.Request) (*oidcState, error) {
+
+	stateCookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		return nil, errors.New("Missing login state. Cookies may be disabled.")
+	}
+
+	stateJson, err := base64.RawURLEncoding.DecodeString(stateCookie.Value)
+	if err != nil {
+		return nil, errors.New("Invalid login state")
+	}
+
+	state := &oidcState{}
+	err = json.Unmarshal(stateJson, state)
+	if err != nil || state.State == "" {
+		return nil, errors.New("Invalid login state")
+	}
+
+	return state, nil
+}
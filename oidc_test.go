@@ -0,0 +1,337 @@
+package gemdrive
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anderspitman/treemess-go"
+)
+
+// mockOidcProvider serves discovery, JWKS and a token endpoint that hands
+// out an ID token with whatever claims the test sets.
+type mockOidcProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mut        sync.Mutex
+	claims     map[string]interface{}
+	signingKey *rsa.PrivateKey
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockOidcProvider{
+		t:          t,
+		key:        key,
+		signingKey: key,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.serveDiscovery)
+	mux.HandleFunc("/keys", p.serveKeys)
+	mux.HandleFunc("/token", p.serveToken)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *mockOidcProvider) setClaims(claims map[string]interface{}) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.claims = claims
+}
+
+func (p *mockOidcProvider) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/auth",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *mockOidcProvider) serveKeys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (p *mockOidcProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	p.mut.Lock()
+	claims := make(map[string]interface{})
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	signingKey := p.signingKey
+	p.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.sign(signingKey, claims),
+	})
+}
+
+func (p *mockOidcProvider) sign(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOidcTestServer(t *testing.T, provider *mockOidcProvider) string {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+
+	driveDir := filepath.Join(tmpDir, "drive")
+	dataDir := filepath.Join(tmpDir, "data")
+
+	for _, dir := range []string{driveDir, dataDir} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:    []string{driveDir},
+		DataDir: dataDir,
+		Oidc: &OidcConfig{
+			Issuer:      provider.server.URL,
+			ClientId:    "gemdrive",
+			RedirectUrl: "http://gemdrive.test/gemdrive/oidc/callback",
+			Templates: []*PrivilegeTemplate{
+				{
+					Email: "*@example.com",
+					Privileges: map[string]string{
+						"/{email}/": "write",
+					},
+				},
+			},
+		},
+	}, treemess.NewTreeMess())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.db.RotateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	return httpServer.URL
+}
+
+// doOidcLogin goes through the login flow, with the provider giving out the
+// claims. It returns the callback's response.
+func doOidcLogin(t *testing.T, baseUrl string, provider *mockOidcProvider, claims map[string]interface{}) *http.Response {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(baseUrl + "/gemdrive/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 302 {
+		t.Fatalf("Login: got %d, want 302", res.StatusCode)
+	}
+
+	authUrl, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(authUrl.String(), provider.server.URL+"/auth") {
+		t.Fatalf("Login redirected to %s", res.Header.Get("Location"))
+	}
+
+	var stateCookie *http.Cookie
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == oidcStateCookieName {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil {
+		t.Fatal("Login didn't set the state cookie")
+	}
+
+	claims["iss"] = provider.server.URL
+	claims["aud"] = "gemdrive"
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	claims["iat"] = time.Now().Unix()
+	claims["nonce"] = authUrl.Query().Get("nonce")
+	provider.setClaims(claims)
+
+	query := url.Values{}
+	query.Set("code", "code")
+	query.Set("state", authUrl.Query().Get("state"))
+
+	req, _ := http.NewRequest("GET", baseUrl+"/gemdrive/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func sessionCookie(res *http.Response) string {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == "access_token" && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestOidcLogin(t *testing.T) {
+
+	provider := newMockOidcProvider(t)
+	baseUrl := newOidcTestServer(t, provider)
+
+	res := doOidcLogin(t, baseUrl, provider, map[string]interface{}{
+		"sub":            "1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	})
+
+	if res.StatusCode != 303 {
+		t.Fatalf("Callback: got %d, want 303", res.StatusCode)
+	}
+
+	sessionKey := sessionCookie(res)
+	if sessionKey == "" {
+		t.Fatal("Callback didn't start a session")
+	}
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/alice@example.com/", sessionKey, "")
+	if status != 200 {
+		t.Fatalf("Creating own directory: got %d", status)
+	}
+
+	status, _ = doRequest(t, "PUT", baseUrl+"/alice@example.com/a.txt", sessionKey, "hello")
+	if status != 200 {
+		t.Fatalf("Writing to own directory: got %d", status)
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+"/", sessionKey, "")
+	if status != 403 {
+		t.Fatalf("Reading outside own directory: got %d, want 403", status)
+	}
+}
+
+func TestOidcLoginRequiresVerifiedEmail(t *testing.T) {
+
+	provider := newMockOidcProvider(t)
+	baseUrl := newOidcTestServer(t, provider)
+
+	for name, claims := range map[string]map[string]interface{}{
+		"unverified": {
+			"sub":            "1",
+			"email":          "alice@example.com",
+			"email_verified": false,
+		},
+		"missing email_verified": {
+			"sub":   "1",
+			"email": "alice@example.com",
+		},
+		"email_verified not a bool": {
+			"sub":            "1",
+			"email":          "alice@example.com",
+			"email_verified": "true",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := doOidcLogin(t, baseUrl, provider, claims)
+
+			if res.StatusCode != 403 {
+				t.Fatalf("Callback: got %d, want 403", res.StatusCode)
+			}
+
+			if sessionCookie(res) != "" {
+				t.Fatal("Callback started a session")
+			}
+		})
+	}
+}
+
+func TestOidcLoginRejectsBadSignature(t *testing.T) {
+
+	provider := newMockOidcProvider(t)
+	baseUrl := newOidcTestServer(t, provider)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.mut.Lock()
+	provider.signingKey = otherKey
+	provider.mut.Unlock()
+
+	res := doOidcLogin(t, baseUrl, provider, map[string]interface{}{
+		"sub":            "1",
+		"email":          "alice@example.com",
+		"email_verified": true,
+	})
+
+	if res.StatusCode != 401 {
+		t.Fatalf("Callback: got %d, want 401", res.StatusCode)
+	}
+}
@@ -0,0 +1,443 @@
+package gemdrive
+
+import (
+	"path"
+	"strings"
+)
+
+// Privileges map path patterns to permissions. A pattern applies to the path
+// it names and everything below it, matching whole path segments, so "/docs"
+// covers "/docs/a.txt" but not "/docs-private". Segments may contain glob
+// patterns as understood by path.Match, e.g. "/users/*/public".
+//
+// The permission is a comma-separated list of:
+//
+//   list         list directory contents
+//   read         read files
+//   create       create new files and directories
+//   append       write to the end of existing files
+//   delete       delete files and directories
+//   manage-keys  create keys with a subset of the key's own privileges
+//
+// "write" is shorthand for all of them and "deny" for none. Overwriting or
+// modifying existing data requires both create and delete, since that's
+// what it amounts to. Keys can only hand out privileges on paths where they
+// have manage-keys, so a plain read key can't create child keys.
+//
+// When several patterns match a path the most specific one wins: the one
+// with the most segments, then the one with the most literal (non-glob)
+// segments. If that still leaves more than one, only the permissions they
+// all grant apply.
+
+type permSet uint
+
+const (
+	permList permSet = 1 << iota
+	permRead
+	permCreate
+	permAppend
+	permDelete
+	permManageKeys
+)
+
+const permAll = permList | permRead | permCreate | permAppend | permDelete | permManageKeys
+
+var permNames = map[string]permSet{
+	"list":        permList,
+	"read":        permRead,
+	"create":      permCreate,
+	"append":      permAppend,
+	"delete":      permDelete,
+	"manage-keys": permManageKeys,
+	"write":       permAll,
+	"deny":        0,
+}
+
+func parsePerms(perm string) (permSet, bool) {
+	var perms permSet
+
+	for _, name := range strings.Split(perm, ",") {
+		p, ok := permNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, false
+		}
+		perms |= p
+	}
+
+	return perms, true
+}
+
+func (p permSet) contains(other permSet) bool {
+	return p&other == other
+}
+
+func (p permSet) String() string {
+	if p == permAll {
+		return "write"
+	}
+
+	names := []string{}
+	for _, name := range []string{"list", "read", "create", "append", "delete", "manage-keys"} {
+		if p.contains(permNames[name]) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "deny"
+	}
+
+	return strings.Join(names, ",")
+}
+
+type privilegeRule struct {
+	segments []string
+	literals int
+	perms    permSet
+	valid    bool
+}
+
+func splitPrivilegePath(pathStr string) []string {
+	trimmed := strings.Trim(pathStr, "/")
+	if trimmed == "" {
+		return []string{}
+	}
+	return strings.Split(trimmed, "/")
+}
+
+// isCanonicalPath reports whether p is absolute and has no empty, "." or
+// ".." segments. Privileges are matched segment by segment, so a path with
+// any of those could match the rules for somewhere other than where the
+// backend ends up resolving it to.
+func isCanonicalPath(p string) bool {
+	if !strings.HasPrefix(p, "/") {
+		return false
+	}
+
+	trimmed := strings.TrimSuffix(p[1:], "/")
+	if trimmed == "" {
+		return true
+	}
+
+	for _, segment := range strings.Split(trimmed, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isGlob(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+func (k KeyData) rules() []privilegeRule {
+	rules := []privilegeRule{}
+
+	for pattern, perm := range k.Privileges {
+		perms, valid := parsePerms(perm)
+
+		rule := privilegeRule{
+			segments: splitPrivilegePath(pattern),
+			perms:    perms,
+			valid:    valid,
+		}
+
+		for _, segment := range rule.segments {
+			if !isGlob(segment) {
+				rule.literals++
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// Compares specificity. Returns a positive number if a is more specific than
+// b, negative if less, and 0 if they're equally specific.
+func (a privilegeRule) compare(b privilegeRule) int {
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) - len(b.segments)
+	}
+	return a.literals - b.literals
+}
+
+func (r privilegeRule) matches(segments []string) bool {
+	if len(r.segments) > len(segments) {
+		return false
+	}
+
+	for i, pattern := range r.segments {
+		matched, err := path.Match(pattern, segments[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether r matches every path that other matches.
+func (r privilegeRule) generalizes(other privilegeRule) bool {
+	if len(r.segments) > len(other.segments) {
+		return false
+	}
+
+	for i, pattern := range r.segments {
+		segment := other.segments[i]
+
+		if pattern == segment || pattern == "*" {
+			continue
+		}
+
+		if isGlob(segment) {
+			return false
+		}
+
+		matched, err := path.Match(pattern, segment)
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reports whether there might be a path matched by both rules. Errs on the
+// side of yes when globs are involved.
+func (r privilegeRule) overlaps(other privilegeRule) bool {
+	n := len(r.segments)
+	if len(other.segments) < n {
+		n = len(other.segments)
+	}
+
+	for i := 0; i < n; i++ {
+		a := r.segments[i]
+		b := other.segments[i]
+
+		switch {
+		case isGlob(a) && isGlob(b):
+			continue
+		case isGlob(a):
+			if matched, _ := path.Match(a, b); !matched {
+				return false
+			}
+		case isGlob(b):
+			if matched, _ := path.Match(b, a); !matched {
+				return false
+			}
+		case a != b:
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r privilegeRule) samePattern(other privilegeRule) bool {
+	if len(r.segments) != len(other.segments) {
+		return false
+	}
+
+	for i := range r.segments {
+		if r.segments[i] != other.segments[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// perms returns what the key can do at a path. Paths that aren't canonical
+// get nothing, so callers don't have to clean them first.
+func (k KeyData) perms(pathStr string) permSet {
+
+	if !isCanonicalPath(pathStr) {
+		return 0
+	}
+
+	segments := splitPrivilegePath(pathStr)
+
+	var best *privilegeRule
+	var perms permSet
+
+	for _, rule := range k.rules() {
+		rule := rule
+
+		if !rule.matches(segments) {
+			continue
+		}
+
+		if best == nil || rule.compare(*best) > 0 {
+			best = &rule
+			perms = rule.perms
+		} else if rule.compare(*best) == 0 {
+			perms &= rule.perms
+		}
+	}
+
+	return perms
+}
+
+// Can reports whether the key has all of the comma-separated permissions for
+// the path.
+func (k KeyData) Can(pathStr, perm string) bool {
+	required, ok := parsePerms(perm)
+	if !ok {
+		return false
+	}
+
+	return k.perms(pathStr).contains(required)
+}
+
+// CanRecursive is like Can, but also requires the permissions for everything
+// below the path. Used for operations on whole directory trees.
+func (k KeyData) CanRecursive(pathStr, perm string) bool {
+	required, ok := parsePerms(perm)
+	if !ok || !k.perms(pathStr).contains(required) {
+		return false
+	}
+
+	// Rules no more specific than the path itself apply the same way to
+	// everything below it, so only the deeper ones can take anything away.
+	target := privilegeRule{
+		segments: splitPrivilegePath(pathStr),
+	}
+
+	for _, rule := range k.rules() {
+		if len(rule.segments) > len(target.segments) && rule.overlaps(target) && !rule.perms.contains(required) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CanAccess reports whether the key has any permissions at all for the path.
+func (k KeyData) CanAccess(pathStr string) bool {
+	return k.perms(pathStr) != 0
+}
+
+func (k KeyData) CanRead(pathStr string) bool {
+	return k.perms(pathStr).contains(permRead)
+}
+
+// CanWrite reports whether the key can make any kind of change to the path.
+func (k KeyData) CanWrite(pathStr string) bool {
+	return k.perms(pathStr).contains(permCreate | permAppend | permDelete)
+}
+
+// IsSubsetOf reports whether k never grants more than other does, for any
+// path. With globs and deny rules in the mix an exact answer is hard to come
+// by, so this is conservative: it may reject some keys that would in fact be
+// subsets, but never accepts one that isn't.
+func (k KeyData) IsSubsetOf(other *KeyData) bool {
+
+	childRules := k.rules()
+	parentRules := other.rules()
+
+	for _, rule := range childRules {
+		if !rule.valid {
+			return false
+		}
+
+		if rule.perms == 0 {
+			continue
+		}
+
+		if !coveredBy(rule, childRules, parentRules) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// limitedTo returns a copy of the key that has at most the given permissions
+// anywhere.
+func (k KeyData) limitedTo(limit permSet) *KeyData {
+	privileges := make(map[string]string)
+
+	for pattern, perm := range k.Privileges {
+		perms, _ := parsePerms(perm)
+		privileges[pattern] = (perms & limit).String()
+	}
+
+	k.Privileges = privileges
+	return &k
+}
+
+// Delegatable returns the privileges the key can pass on to keys it creates,
+// which are the ones that come with manage-keys.
+func (k KeyData) Delegatable() *KeyData {
+	privileges := make(map[string]string)
+
+	for pattern, perm := range k.Privileges {
+		perms, ok := parsePerms(perm)
+		if ok && perms.contains(permManageKeys) {
+			privileges[pattern] = perm
+		} else {
+			privileges[pattern] = "deny"
+		}
+	}
+
+	return &KeyData{
+		Privileges: privileges,
+	}
+}
+
+// Checks that wherever rule decides the child's access, the parent grants at
+// least as much.
+func coveredBy(rule privilegeRule, childRules, parentRules []privilegeRule) bool {
+
+	// Some parent rule must grant enough for everything the rule matches
+	covered := false
+	for _, parentRule := range parentRules {
+		if parentRule.generalizes(rule) && parentRule.perms.contains(rule.perms) {
+			covered = true
+			break
+		}
+	}
+
+	if !covered {
+		return false
+	}
+
+	// Parent rules granting less might win in parts of that area. Each one
+	// must either be beaten by a more specific parent rule that grants
+	// enough, or be matched by a child rule that takes precedence over this
+	// one and grants no more than it.
+	for _, lower := range parentRules {
+		if lower.perms.contains(rule.perms) || !lower.overlaps(rule) {
+			continue
+		}
+
+		overridden := false
+
+		for _, parentRule := range parentRules {
+			if parentRule.generalizes(rule) && parentRule.perms.contains(rule.perms) && parentRule.compare(lower) > 0 {
+				overridden = true
+				break
+			}
+		}
+
+		for _, childRule := range childRules {
+			if overridden {
+				break
+			}
+
+			if childRule.samePattern(lower) && lower.perms.contains(childRule.perms) && childRule.compare(rule) >= 0 {
+				overridden = true
+			}
+		}
+
+		if !overridden {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,35 @@
+package gemdrive
+
+import (
+	"testing"
+)
+
+func TestPermsDenyNonCanonicalPaths(t *testing.T) {
+
+	keyData := KeyData{
+		Privileges: map[string]string{
+			"/":             "write",
+			"/docs/private": "deny",
+		},
+	}
+
+	if !keyData.Can("/docs/a.txt", "create") {
+		t.Fatal("Can't write to a canonical path")
+	}
+
+	for _, p := range []string{
+		"/docs/../docs/private/a.txt",
+		"/docs/./private",
+		"/docs//private",
+		"/docs/..",
+		"docs/a.txt",
+	} {
+		if keyData.CanAccess(p) {
+			t.Errorf("%s: has access", p)
+		}
+
+		if keyData.CanRecursive(p, "delete") {
+			t.Errorf("%s: can delete recursively", p)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"path"
 	"strings"
 )
 
@@ -58,6 +59,21 @@ func (b *RcloneBackend) Read(reqPath string, offset, length int64) (*Item, io.Re
 		return nil, nil, err
 	}
 
+	// Listing a directory gives its children rather than the directory
+	if len(rcloneItems) != 1 || rcloneItems[0].IsDir || rcloneItems[0].Name != path.Base(reqPath) {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if offset < 0 || offset > rcloneItems[0].Size || length < 0 {
+		return nil, nil, &Error{
+			HttpCode: 416,
+			Message:  "Invalid range",
+		}
+	}
+
 	item := &Item{
 		Size:    rcloneItems[0].Size,
 		ModTime: rcloneItems[0].ModTime,
@@ -123,7 +139,12 @@ func (b *RcloneBackend) rcloneLs(reqPath string) ([]rcloneItem, error) {
 	rclonePath := parts[1] + ":" + strings.Join(parts[2:], "/")
 	cmd := exec.Command("rclone", "lsjson", rclonePath)
 	stdout, err := cmd.Output()
-	if err != nil {
+	if exitErr, ok := err.(*exec.ExitError); ok && isRcloneNotFound(exitErr.ExitCode()) {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -135,3 +156,8 @@ func (b *RcloneBackend) rcloneLs(reqPath string) ([]rcloneItem, error) {
 
 	return rcloneItems, nil
 }
+
+// See https://rclone.org/docs/#exit-code
+func isRcloneNotFound(exitCode int) bool {
+	return exitCode == 3 || exitCode == 4
+}
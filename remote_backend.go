@@ -0,0 +1,140 @@
+package gemdrive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GemDriveRemoteBackend serves a directory on another GemDrive server, using
+// its regular HTTP interface. Mounted in a MultiBackend it lets one server
+// present several under a single namespace. What can be reached is limited
+// by the key it's given.
+type GemDriveRemoteBackend struct {
+	client *Client
+	root   string
+}
+
+// NewGemDriveRemoteBackend takes the URL of the remote directory, e.g.
+// https://example.com/photos, and the key to use with it.
+func NewGemDriveRemoteBackend(remoteUrl, key string) (*GemDriveRemoteBackend, error) {
+
+	u, err := url.Parse(remoteUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("Remote URL must be http or https")
+	}
+
+	client, err := NewClient(u.Scheme+"://"+u.Host, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GemDriveRemoteBackend{
+		client: client,
+		root:   strings.TrimSuffix(u.Path, "/"),
+	}, nil
+}
+
+func (b *GemDriveRemoteBackend) List(reqPath string, depth int) (*Item, error) {
+	return b.client.Tree(b.root+reqPath, depth)
+}
+
+func (b *GemDriveRemoteBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	return b.client.Read(b.root+reqPath, offset, length)
+}
+
+func (b *GemDriveRemoteBackend) MakeDir(reqPath string, recursive bool) error {
+	return b.client.MakeDir(b.root+reqPath, recursive)
+}
+
+// Truncating writes are done with PUT and the rest with PATCH.
+func (b *GemDriveRemoteBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+
+	if offset < 0 {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Invalid offset",
+		}
+	}
+
+	opts := &WriteOptions{
+		Overwrite: overwrite,
+	}
+
+	if !truncate {
+		return b.client.Patch(b.root+reqPath, data, offset, length, opts)
+	}
+
+	if offset == 0 {
+		return b.client.Write(b.root+reqPath, data, length, opts)
+	}
+
+	// PUT replaces the whole file, so anything before the offset is
+	// zero-filled like it would be by writing past the end.
+	if length >= 0 {
+		length += offset
+	}
+
+	body := io.MultiReader(io.LimitReader(zeroReader{}, offset), data)
+
+	return b.client.Write(b.root+reqPath, body, length, opts)
+}
+
+func (b *GemDriveRemoteBackend) SetAttributes(reqPath string, modTime time.Time, isExecutable bool) error {
+	return b.client.SetAttributes(b.root+reqPath, modTime, isExecutable)
+}
+
+func (b *GemDriveRemoteBackend) Delete(reqPath string, recursive bool) error {
+	return b.client.Delete(b.root+reqPath, recursive)
+}
+
+func (b *GemDriveRemoteBackend) Move(srcPath, dstPath string, overwrite bool) error {
+	return b.client.Move(b.root+srcPath, b.root+dstPath, overwrite)
+}
+
+func (b *GemDriveRemoteBackend) Copy(srcPath, dstPath string, overwrite bool) error {
+	return b.client.Copy(b.root+srcPath, b.root+dstPath, overwrite)
+}
+
+func (b *GemDriveRemoteBackend) GetImage(reqPath string, size int) (io.Reader, int64, error) {
+
+	img, err := b.client.GetImage(b.root+reqPath, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer img.Close()
+
+	// Thumbnails are small, and reading them here means the response
+	// doesn't need to be closed by the caller.
+	data, err := ioutil.ReadAll(img)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+var (
+	_ Backend         = (*GemDriveRemoteBackend)(nil)
+	_ WritableBackend = (*GemDriveRemoteBackend)(nil)
+	_ Mover           = (*GemDriveRemoteBackend)(nil)
+	_ Copier          = (*GemDriveRemoteBackend)(nil)
+	_ ImageServer     = (*GemDriveRemoteBackend)(nil)
+)
@@ -43,7 +43,9 @@ func (s *Server) remoteGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !s.keyAuth.CanWrite(key, reqData.Destination) {
+	eventType := s.writeEventType(reqData.Destination, reqData.Overwrite)
+
+	if !s.keyAuth.Can(key, reqData.Destination, writePerm(eventType)) {
 		w.WriteHeader(403)
 		io.WriteString(w, "remote-get: You don't have permission to write to "+reqData.Destination)
 		return
@@ -71,7 +73,11 @@ func (s *Server) remoteGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = backend.Write(reqData.Destination, resp.Body, reqData.DestinationOffset, resp.ContentLength, reqData.Overwrite, reqData.Truncate)
-	if err != nil {
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, "remote-get: "+e.Message)
+		return
+	} else if err != nil {
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
 		return
@@ -99,4 +105,6 @@ func (s *Server) remoteGet(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+
+	s.emit(eventType, reqData.Destination)
 }
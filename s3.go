@@ -0,0 +1,1493 @@
+package gemdrive
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The S3 API is served for any request signed with AWS Signature Version 4.
+// Buckets are the top-level directories of the drive. The access key ID is a
+// GemDrive key's ID, and the secret access key is derived from the key, so
+// the key itself never goes over the wire. Key holders get the pair from
+// /gemdrive/s3-credentials.
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+const s3TimeFormat = "20060102T150405Z"
+const s3EmptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+const s3MaxSkew = 15 * time.Minute
+const s3MaxChunkSize = 64 * 1024 * 1024
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+
+	httpCode int
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+var (
+	s3ErrAccessDenied          = &s3Error{Code: "AccessDenied", Message: "Access Denied", httpCode: 403}
+	s3ErrInvalidAccessKeyId    = &s3Error{Code: "InvalidAccessKeyId", Message: "The access key ID does not exist", httpCode: 403}
+	s3ErrSignatureDoesNotMatch = &s3Error{Code: "SignatureDoesNotMatch", Message: "The request signature does not match", httpCode: 403}
+	s3ErrRequestTimeTooSkewed  = &s3Error{Code: "RequestTimeTooSkewed", Message: "The request time is too far from the server time", httpCode: 403}
+	s3ErrExpired               = &s3Error{Code: "AccessDenied", Message: "Request has expired", httpCode: 403}
+	s3ErrNoSuchBucket          = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", httpCode: 404}
+	s3ErrNoSuchKey             = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist", httpCode: 404}
+	s3ErrNoSuchUpload          = &s3Error{Code: "NoSuchUpload", Message: "The specified upload does not exist", httpCode: 404}
+	s3ErrInvalidPart           = &s3Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found", httpCode: 400}
+	s3ErrInvalidPartOrder      = &s3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order", httpCode: 400}
+	s3ErrBadDigest             = &s3Error{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what was received", httpCode: 400}
+	s3ErrSha256Mismatch        = &s3Error{Code: "XAmzContentSHA256Mismatch", Message: "The X-Amz-Content-Sha256 you specified did not match what was received", httpCode: 400}
+	s3ErrMalformedXML          = &s3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed", httpCode: 400}
+	s3ErrInvalidArgument       = &s3Error{Code: "InvalidArgument", Message: "Invalid argument", httpCode: 400}
+	s3ErrMissingContentLength  = &s3Error{Code: "MissingContentLength", Message: "You must provide the Content-Length HTTP header", httpCode: 411}
+	s3ErrNotImplemented        = &s3Error{Code: "NotImplemented", Message: "A header or operation you provided is not implemented", httpCode: 501}
+)
+
+func isS3Request(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		return true
+	}
+	return r.URL.Query().Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256"
+}
+
+func (s *Server) handleS3(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+
+	// The generic handler guesses a content type from the extension, which
+	// doesn't make sense for XML responses.
+	w.Header().Del("Content-Type")
+
+	keyId, key, sig, err := s.s3Authenticate(r)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	if !s.db.UseKeyId(keyId) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	setAuditKey(r, keyId, key)
+
+	if sig != nil {
+		r.Body = sig.body
+	}
+
+	bucket, objectKey := s3SplitPath(r.URL.Path)
+	query := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method == "GET" {
+			s.s3ListBuckets(w, r, key, mappedRoot)
+			return
+		}
+		s.sendS3Error(w, r, s3ErrNotImplemented)
+		return
+	}
+
+	bucketPath := mappedRoot + "/" + bucket + "/"
+
+	if objectKey == "" {
+		switch r.Method {
+		case "HEAD":
+			s.s3HeadBucket(w, r, key, bucketPath)
+		case "GET":
+			if _, ok := query["location"]; ok {
+				s.s3GetBucketLocation(w, r, key, bucketPath)
+			} else {
+				s.s3ListObjects(w, r, key, bucket, bucketPath)
+			}
+		case "POST":
+			if _, ok := query["delete"]; ok {
+				s.s3DeleteObjects(w, r, key, bucketPath)
+			} else {
+				s.sendS3Error(w, r, s3ErrNotImplemented)
+			}
+		default:
+			s.sendS3Error(w, r, s3ErrNotImplemented)
+		}
+		return
+	}
+
+	objectPath := bucketPath + objectKey
+	uploadId := query.Get("uploadId")
+
+	switch r.Method {
+	case "HEAD":
+		s.s3HeadObject(w, r, key, objectPath)
+	case "GET":
+		s.s3GetObject(w, r, key, objectPath)
+	case "PUT":
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			s.sendS3Error(w, r, s3ErrNotImplemented)
+		} else if uploadId != "" {
+			s.s3UploadPart(w, r, key, sig, objectPath, uploadId)
+		} else {
+			s.s3PutObject(w, r, key, sig, objectPath)
+		}
+	case "POST":
+		if _, ok := query["uploads"]; ok {
+			s.s3CreateMultipartUpload(w, r, key, bucket, objectKey, objectPath)
+		} else if uploadId != "" {
+			s.s3CompleteMultipartUpload(w, r, key, bucket, objectKey, objectPath, uploadId)
+		} else {
+			s.sendS3Error(w, r, s3ErrNotImplemented)
+		}
+	case "DELETE":
+		if uploadId != "" {
+			s.s3AbortMultipartUpload(w, r, key, objectPath, uploadId)
+		} else {
+			s.s3DeleteObject(w, r, key, objectPath)
+		}
+	default:
+		s.sendS3Error(w, r, s3ErrNotImplemented)
+	}
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func (s *Server) s3ListBuckets(w http.ResponseWriter, r *http.Request, key *KeyData, mappedRoot string) {
+
+	root, err := s.backend.List(mappedRoot+"/", 1)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	result := &s3ListAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{
+			ID:          "gemdrive",
+			DisplayName: "gemdrive",
+		},
+		Buckets: []s3Bucket{},
+	}
+
+	names := []string{}
+	for name := range root.Children {
+		if strings.HasSuffix(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !key.CanAccess(mappedRoot + "/" + name) {
+			continue
+		}
+
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         strings.TrimSuffix(name, "/"),
+			CreationDate: s3Time(root.Children[name].ModTime),
+		})
+	}
+
+	sendS3Xml(w, 200, result)
+}
+
+func (s *Server) s3HeadBucket(w http.ResponseWriter, r *http.Request, key *KeyData, bucketPath string) {
+
+	if !key.CanAccess(bucketPath) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	_, isDir, err := statItem(s.backend, bucketPath)
+	if err != nil || !isDir {
+		s.sendS3Error(w, r, s3ErrNoSuchBucket)
+		return
+	}
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+func (s *Server) s3GetBucketLocation(w http.ResponseWriter, r *http.Request, key *KeyData, bucketPath string) {
+
+	if !key.CanAccess(bucketPath) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	_, isDir, err := statItem(s.backend, bucketPath)
+	if err != nil || !isDir {
+		s.sendS3Error(w, r, s3ErrNoSuchBucket)
+		return
+	}
+
+	sendS3Xml(w, 200, &s3LocationConstraint{Xmlns: s3Namespace})
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *Server) s3ListObjects(w http.ResponseWriter, r *http.Request, key *KeyData, bucket, bucketPath string) {
+
+	query := r.URL.Query()
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encodingType := query.Get("encoding-type")
+	startAfter := query.Get("start-after")
+	continuationToken := query.Get("continuation-token")
+
+	maxKeys := 1000
+	if maxKeysParam := query.Get("max-keys"); maxKeysParam != "" {
+		var err error
+		maxKeys, err = strconv.Atoi(maxKeysParam)
+		if err != nil || maxKeys < 0 {
+			s.sendS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+		if maxKeys > 1000 {
+			maxKeys = 1000
+		}
+	}
+
+	if delimiter != "" && delimiter != "/" {
+		// Other delimiters would require listing the entire bucket.
+		s.sendS3Error(w, r, s3ErrNotImplemented)
+		return
+	}
+
+	if !key.Can(bucketPath, "list") {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	_, isDir, err := statItem(s.backend, bucketPath)
+	if err != nil || !isDir {
+		s.sendS3Error(w, r, s3ErrNoSuchBucket)
+		return
+	}
+
+	marker := startAfter
+	if continuationToken != "" {
+		tokenBytes, err := base64.RawURLEncoding.DecodeString(continuationToken)
+		if err != nil {
+			s.sendS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+		marker = string(tokenBytes)
+	}
+
+	// Only the directory containing the prefix needs to be listed. Without
+	// a delimiter the entire subtree is needed.
+	prefixDir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		prefixDir = prefix[:i+1]
+	}
+
+	depth := 0
+	if delimiter == "/" {
+		depth = 1
+	}
+
+	entries := []s3Object{}
+	commonPrefixes := []string{}
+
+	listing, err := s.backend.List(bucketPath+prefixDir, depth)
+	if err == nil {
+		s.s3FlattenListing(key, bucketPath, prefixDir, listing, delimiter == "/", &entries, &commonPrefixes)
+	}
+
+	type listEntry struct {
+		key      string
+		object   *s3Object
+		isPrefix bool
+	}
+
+	all := []listEntry{}
+	for i := range entries {
+		if strings.HasPrefix(entries[i].Key, prefix) {
+			all = append(all, listEntry{key: entries[i].Key, object: &entries[i]})
+		}
+	}
+	for _, p := range commonPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			all = append(all, listEntry{key: p, isPrefix: true})
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].key < all[j].key
+	})
+
+	result := &s3ListBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		EncodingType:      encodingType,
+		ContinuationToken: continuationToken,
+		StartAfter:        startAfter,
+	}
+
+	encode := func(k string) string {
+		if encodingType == "url" {
+			return url.QueryEscape(k)
+		}
+		return k
+	}
+
+	for _, entry := range all {
+		if entry.key <= marker {
+			continue
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		if entry.isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry.key)})
+		} else {
+			object := *entry.object
+			object.Key = encode(object.Key)
+			result.Contents = append(result.Contents, object)
+		}
+
+		result.KeyCount++
+		marker = entry.key
+	}
+
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(marker))
+	}
+
+	result.Prefix = encode(result.Prefix)
+	result.StartAfter = encode(result.StartAfter)
+
+	sendS3Xml(w, 200, result)
+}
+
+func (s *Server) s3FlattenListing(key *KeyData, bucketPath, dirKey string, item *Item, useDelimiter bool, entries *[]s3Object, commonPrefixes *[]string) {
+
+	for name, child := range item.Children {
+
+		childKey := dirKey + name
+
+		if !key.CanAccess(bucketPath + childKey) {
+			continue
+		}
+
+		if strings.HasSuffix(name, "/") {
+			if useDelimiter {
+				*commonPrefixes = append(*commonPrefixes, childKey)
+			} else if key.Can(bucketPath+childKey, "list") {
+				s.s3FlattenListing(key, bucketPath, childKey, child, useDelimiter, entries, commonPrefixes)
+			}
+			continue
+		}
+
+		*entries = append(*entries, s3Object{
+			Key:          childKey,
+			LastModified: s3Time(child.ModTime),
+			ETag:         s.itemETag(bucketPath+childKey, child),
+			Size:         child.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+}
+
+func (s *Server) s3HeadObject(w http.ResponseWriter, r *http.Request, key *KeyData, objectPath string) {
+
+	if !key.CanRead(objectPath) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	item, isDir, err := statItem(s.backend, objectPath)
+	if err != nil || isDir {
+		s.sendS3Error(w, r, s3ErrNoSuchKey)
+		return
+	}
+
+	modTime, err := time.Parse(time.RFC3339, item.ModTime)
+	if err == nil {
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", item.Size))
+	w.Header().Set("Accept-Ranges", "bytes")
+	s.setValidatorHeaders(w, objectPath, item)
+}
+
+func (s *Server) s3GetObject(w http.ResponseWriter, r *http.Request, key *KeyData, objectPath string) {
+
+	if !key.CanRead(objectPath) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	_, isDir, err := statItem(s.backend, objectPath)
+	if err != nil || isDir {
+		s.sendS3Error(w, r, s3ErrNoSuchKey)
+		return
+	}
+
+	// serveFile sets the ETag
+	s.serveFile(w, r, objectPath)
+}
+
+func (s *Server) s3PutObject(w http.ResponseWriter, r *http.Request, key *KeyData, sig *s3Signature, objectPath string) {
+
+	eventType := "create"
+	if !strings.HasSuffix(objectPath, "/") {
+		eventType = s.writeEventType(objectPath, true)
+	}
+
+	if !key.Can(objectPath, writePerm(eventType)) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	size, err := s3ContentLength(r)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	// Directory markers
+	if strings.HasSuffix(objectPath, "/") {
+		if size != 0 {
+			s.sendS3Error(w, r, s3ErrInvalidArgument)
+			return
+		}
+
+		err := backend.MakeDir(objectPath, true)
+		if err != nil {
+			s.sendS3Error(w, r, err)
+			return
+		}
+
+		s.emit("create", objectPath)
+
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		return
+	}
+
+	// The payload hash and Content-MD5 can only be checked once the whole
+	// body is in, so it's staged first to leave any existing object alone
+	// if they don't match.
+	tmpFile, err := ioutil.TempFile(s.config.CacheDir, "s3-put-")
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	md5Hash := md5.New()
+
+	n, err := io.Copy(io.MultiWriter(tmpFile, md5Hash), io.LimitReader(r.Body, size+1))
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	if n != size {
+		s.sendS3Error(w, r, s3ErrInvalidArgument)
+		return
+	}
+
+	sum := md5Hash.Sum(nil)
+
+	if contentMd5 := r.Header.Get("Content-MD5"); contentMd5 != "" {
+		if contentMd5 != base64.StdEncoding.EncodeToString(sum) {
+			s.sendS3Error(w, r, s3ErrBadDigest)
+			return
+		}
+	}
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	err = backend.MakeDir(path.Dir(objectPath)+"/", true)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	err = backend.Write(objectPath, tmpFile, 0, size, true, true)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	s.emit(eventType, objectPath)
+
+	s.setS3ObjectETag(w, objectPath)
+}
+
+func (s *Server) s3DeleteObject(w http.ResponseWriter, r *http.Request, key *KeyData, objectPath string) {
+
+	if !key.Can(objectPath, "delete") {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	// S3 doesn't report an error when deleting a key that doesn't exist.
+	_, isDir, err := statItem(s.backend, objectPath)
+	if err == nil && isDir == strings.HasSuffix(objectPath, "/") {
+		err = backend.Delete(objectPath, false)
+		if err != nil {
+			s.sendS3Error(w, r, err)
+			return
+		}
+
+		s.emit("delete", objectPath)
+	}
+
+	w.WriteHeader(204)
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name          `xml:"DeleteResult"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	Deleted []s3DeletedObject `xml:"Deleted"`
+	Errors  []s3DeleteError   `xml:"Error"`
+}
+
+type s3DeletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *Server) s3DeleteObjects(w http.ResponseWriter, r *http.Request, key *KeyData, bucketPath string) {
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 2*1024*1024))
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	deleteReq := &s3DeleteRequest{}
+	err = xml.Unmarshal(body, deleteReq)
+	if err != nil {
+		s.sendS3Error(w, r, s3ErrMalformedXML)
+		return
+	}
+
+	result := &s3DeleteResult{
+		Xmlns: s3Namespace,
+	}
+
+	for _, object := range deleteReq.Objects {
+		objectPath := bucketPath + object.Key
+
+		// Unlike URL paths, keys in the body haven't been cleaned
+		if !isCanonicalPath(objectPath) {
+			result.Errors = append(result.Errors, s3DeleteError{
+				Key:     object.Key,
+				Code:    s3ErrInvalidArgument.Code,
+				Message: s3ErrInvalidArgument.Message,
+			})
+			continue
+		}
+
+		if !key.Can(objectPath, "delete") {
+			result.Errors = append(result.Errors, s3DeleteError{
+				Key:     object.Key,
+				Code:    s3ErrAccessDenied.Code,
+				Message: s3ErrAccessDenied.Message,
+			})
+			continue
+		}
+
+		_, isDir, err := statItem(s.backend, objectPath)
+		if err == nil && isDir == strings.HasSuffix(objectPath, "/") {
+			err = backend.Delete(objectPath, false)
+			if err != nil {
+				result.Errors = append(result.Errors, s3DeleteError{
+					Key:     object.Key,
+					Code:    "InternalError",
+					Message: err.Error(),
+				})
+				continue
+			}
+
+			s.emit("delete", objectPath)
+		}
+
+		if !deleteReq.Quiet {
+			result.Deleted = append(result.Deleted, s3DeletedObject{Key: object.Key})
+		}
+	}
+
+	sendS3Xml(w, 200, result)
+}
+
+type s3Upload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Path   string `json:"path"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+func (s *Server) s3UploadDir(uploadId string) (string, error) {
+	if !isRandomKey(uploadId) {
+		return "", s3ErrNoSuchUpload
+	}
+	return filepath.Join(s.config.DataDir, "s3_uploads", uploadId), nil
+}
+
+func (s *Server) s3LoadUpload(uploadId, objectPath string) (*s3Upload, string, error) {
+
+	uploadDir, err := s.s3UploadDir(uploadId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	upload := &s3Upload{}
+	err = loadJson(upload, filepath.Join(uploadDir, "upload.json"))
+	if err != nil {
+		return nil, "", s3ErrNoSuchUpload
+	}
+
+	if upload.Path != objectPath {
+		return nil, "", s3ErrNoSuchUpload
+	}
+
+	return upload, uploadDir, nil
+}
+
+func (s *Server) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, key *KeyData, bucket, objectKey, objectPath string) {
+
+	if !key.Can(objectPath, "create") {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	if _, ok := s.backend.(WritableBackend); !ok {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	uploadId, err := genRandomKey()
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	uploadDir, _ := s.s3UploadDir(uploadId)
+
+	err = os.MkdirAll(uploadDir, 0700)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	upload := &s3Upload{
+		Bucket: bucket,
+		Key:    objectKey,
+		Path:   objectPath,
+	}
+
+	err = saveJson(upload, filepath.Join(uploadDir, "upload.json"))
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	sendS3Xml(w, 200, &s3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      objectKey,
+		UploadId: uploadId,
+	})
+}
+
+func (s *Server) s3UploadPart(w http.ResponseWriter, r *http.Request, key *KeyData, sig *s3Signature, objectPath, uploadId string) {
+
+	if !key.Can(objectPath, "create") {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		s.sendS3Error(w, r, s3ErrInvalidArgument)
+		return
+	}
+
+	_, uploadDir, err := s.s3LoadUpload(uploadId, objectPath)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	size, err := s3ContentLength(r)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	partPath := filepath.Join(uploadDir, fmt.Sprintf("part_%05d", partNumber))
+
+	partFile, err := os.Create(partPath)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+	defer partFile.Close()
+
+	md5Hash := md5.New()
+
+	n, err := io.Copy(io.MultiWriter(partFile, md5Hash), r.Body)
+	if err != nil || n != size {
+		os.Remove(partPath)
+		s.sendS3Error(w, r, s3ErrInvalidArgument)
+		return
+	}
+
+	sum := md5Hash.Sum(nil)
+
+	if contentMd5 := r.Header.Get("Content-MD5"); contentMd5 != "" {
+		if contentMd5 != base64.StdEncoding.EncodeToString(sum) {
+			os.Remove(partPath)
+			s.sendS3Error(w, r, s3ErrBadDigest)
+			return
+		}
+	}
+
+	// Kept so CompleteMultipartUpload can check the parts it's given are
+	// the ones that were uploaded
+	etag := hex.EncodeToString(sum)
+
+	err = ioutil.WriteFile(partPath+".etag", []byte(etag), 0600)
+	if err != nil {
+		os.Remove(partPath)
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func (s *Server) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, key *KeyData, bucket, objectKey, objectPath, uploadId string) {
+
+	eventType := s.writeEventType(objectPath, true)
+
+	if !key.Can(objectPath, writePerm(eventType)) {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	_, uploadDir, err := s.s3LoadUpload(uploadId, objectPath)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 2*1024*1024))
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	completeReq := &s3CompleteMultipartUpload{}
+	err = xml.Unmarshal(body, completeReq)
+	if err != nil || len(completeReq.Parts) == 0 {
+		s.sendS3Error(w, r, s3ErrMalformedXML)
+		return
+	}
+
+	var totalSize int64 = 0
+	readers := []io.Reader{}
+	lastPartNumber := 0
+
+	for _, part := range completeReq.Parts {
+		if part.PartNumber <= lastPartNumber {
+			s.sendS3Error(w, r, s3ErrInvalidPartOrder)
+			return
+		}
+		lastPartNumber = part.PartNumber
+
+		partPath := filepath.Join(uploadDir, fmt.Sprintf("part_%05d", part.PartNumber))
+
+		partFile, err := os.Open(partPath)
+		if err != nil {
+			s.sendS3Error(w, r, s3ErrInvalidPart)
+			return
+		}
+		defer partFile.Close()
+
+		stat, err := partFile.Stat()
+		if err != nil {
+			s.sendS3Error(w, r, err)
+			return
+		}
+
+		storedEtag, err := ioutil.ReadFile(partPath + ".etag")
+		if err != nil || !strings.EqualFold(strings.Trim(part.ETag, `"`), string(storedEtag)) {
+			s.sendS3Error(w, r, s3ErrInvalidPart)
+			return
+		}
+
+		totalSize += stat.Size()
+		readers = append(readers, partFile)
+	}
+
+	err = backend.MakeDir(path.Dir(objectPath)+"/", true)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	err = backend.Write(objectPath, io.MultiReader(readers...), 0, totalSize, true, true)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	s.emit(eventType, objectPath)
+
+	os.RemoveAll(uploadDir)
+
+	etag := ""
+	if item, _, err := statItem(s.backend, objectPath); err == nil {
+		etag = s.itemETag(objectPath, item)
+	}
+
+	sendS3Xml(w, 200, &s3CompleteMultipartUploadResult{
+		Xmlns:  s3Namespace,
+		Bucket: bucket,
+		Key:    objectKey,
+		ETag:   etag,
+	})
+}
+
+func (s *Server) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, key *KeyData, objectPath, uploadId string) {
+
+	if !key.Can(objectPath, "create") {
+		s.sendS3Error(w, r, s3ErrAccessDenied)
+		return
+	}
+
+	_, uploadDir, err := s.s3LoadUpload(uploadId, objectPath)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	err = os.RemoveAll(uploadDir)
+	if err != nil {
+		s.sendS3Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *Server) sendS3Error(w http.ResponseWriter, r *http.Request, err error) {
+
+	s3Err, ok := err.(*s3Error)
+	if !ok {
+		code := 500
+		if e, ok := err.(*Error); ok {
+			code = e.HttpCode
+		}
+
+		switch code {
+		case 403:
+			s3Err = s3ErrAccessDenied
+		case 404:
+			s3Err = s3ErrNoSuchKey
+		default:
+			s3Err = &s3Error{
+				Code:     "InternalError",
+				Message:  err.Error(),
+				httpCode: 500,
+			}
+		}
+	}
+
+	resp := *s3Err
+	resp.Resource = r.URL.Path
+
+	// HEAD responses can't have a body
+	if r.Method == "HEAD" {
+		w.WriteHeader(resp.httpCode)
+		return
+	}
+
+	sendS3Xml(w, resp.httpCode, &resp)
+}
+
+func sendS3Xml(w http.ResponseWriter, code int, data interface{}) {
+	body, err := xml.Marshal(data)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+func s3SplitPath(urlPath string) (string, string) {
+	trimmed := strings.TrimPrefix(urlPath, "/")
+
+	parts := strings.SplitN(trimmed, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+func s3ContentLength(r *http.Request) (int64, error) {
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+		size, err := strconv.ParseInt(decoded, 10, 64)
+		if err != nil {
+			return 0, s3ErrInvalidArgument
+		}
+		return size, nil
+	}
+
+	if r.ContentLength < 0 {
+		return 0, s3ErrMissingContentLength
+	}
+
+	return r.ContentLength, nil
+}
+
+func s3Time(modTime string) string {
+	t, err := time.Parse(time.RFC3339, modTime)
+	if err != nil {
+		t = time.Unix(0, 0)
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// S3 clients expect an ETag on every object. Objects get the same one the
+// rest of the server uses, rather than an MD5, so that it matches across
+// GET, HEAD, listings and writes. Content-MD5 is still checked on upload.
+func (s *Server) setS3ObjectETag(w http.ResponseWriter, objectPath string) {
+	item, _, err := statItem(s.backend, objectPath)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("ETag", s.itemETag(objectPath, item))
+}
+
+type s3Signature struct {
+	signingKey []byte
+	scope      string
+	amzDate    string
+	signature  string
+	body       io.ReadCloser
+}
+
+// s3Authenticate verifies the AWS Signature Version 4 on the request, either
+// in the Authorization header or in the query string for presigned URLs, and
+// returns the ID and data of the GemDrive key it was signed with.
+func (s *Server) s3Authenticate(r *http.Request) (string, *KeyData, *s3Signature, error) {
+
+	query := r.URL.Query()
+
+	var credential, signedHeadersStr, signature, amzDate, payloadHash string
+	presigned := false
+
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "AWS4-HMAC-SHA256 ") {
+		fields := strings.Split(authHeader[len("AWS4-HMAC-SHA256 "):], ",")
+		for _, field := range fields {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeadersStr = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = r.Header.Get("Date")
+		}
+
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+	} else {
+		presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeadersStr = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	credParts := strings.Split(credential, "/")
+	if len(credParts) != 5 || credParts[4] != "aws4_request" || signature == "" {
+		return "", nil, nil, s3ErrInvalidArgument
+	}
+
+	keyId := credParts[0]
+	scope := strings.Join(credParts[1:], "/")
+
+	keyData, err := s.db.GetKeyDataById(keyId)
+	if err != nil {
+		return "", nil, nil, s3ErrInvalidAccessKeyId
+	}
+
+	if !keyData.IsValid() {
+		return "", nil, nil, s3ErrAccessDenied
+	}
+
+	reqTime, err := time.Parse(s3TimeFormat, amzDate)
+	if err != nil {
+		return "", nil, nil, s3ErrAccessDenied
+	}
+
+	now := time.Now()
+
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 {
+			return "", nil, nil, s3ErrInvalidArgument
+		}
+
+		if now.After(reqTime.Add(time.Duration(expires) * time.Second)) {
+			return "", nil, nil, s3ErrExpired
+		}
+	} else if reqTime.Sub(now) > s3MaxSkew || now.Sub(reqTime) > s3MaxSkew {
+		return "", nil, nil, s3ErrRequestTimeTooSkewed
+	}
+
+	signedHeaders := strings.Split(signedHeadersStr, ";")
+
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		canonicalHeaders += name + ":" + strings.Join(strings.Fields(value), " ") + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3UriEncode(r.URL.Path, false),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeadersStr,
+		payloadHash,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := s3SigningKey(s.keyAuth.s3Secret(keyData), credParts[1], credParts[2], credParts[3])
+
+	expected := hex.EncodeToString(s3Hmac(signingKey, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", nil, nil, s3ErrSignatureDoesNotMatch
+	}
+
+	sig := &s3Signature{
+		signingKey: signingKey,
+		scope:      scope,
+		amzDate:    amzDate,
+		signature:  signature,
+	}
+
+	switch payloadHash {
+	case "UNSIGNED-PAYLOAD":
+		sig.body = r.Body
+	case "STREAMING-AWS4-HMAC-SHA256-PAYLOAD":
+		sig.body = &s3ChunkedReader{
+			body:    r.Body,
+			reader:  bufio.NewReader(r.Body),
+			sig:     sig,
+			prevSig: signature,
+			signed:  true,
+		}
+	case "STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+		sig.body = &s3ChunkedReader{
+			body:   r.Body,
+			reader: bufio.NewReader(r.Body),
+		}
+	default:
+		expectedHash, err := hex.DecodeString(payloadHash)
+		if err != nil || len(expectedHash) != sha256.Size {
+			return "", nil, nil, s3ErrNotImplemented
+		}
+
+		sig.body = &s3VerifyingReader{
+			body:     r.Body,
+			hash:     sha256.New(),
+			expected: expectedHash,
+		}
+	}
+
+	return keyId, keyData, sig, nil
+}
+
+// s3Secret is the secret access key that goes with a key. Like the secret
+// for signed URLs it's derived from the key's salt, so it changes whenever
+// the key does.
+func (a *KeyAuth) s3Secret(keyData *KeyData) string {
+	mac := hmac.New(sha256.New, a.signingSecret)
+	mac.Write([]byte("s3:" + keyData.Salt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type s3Credentials struct {
+	AccessKeyId     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
+func (s *Server) serveS3Credentials(w http.ResponseWriter, r *http.Request) {
+
+	token, _ := extractToken(r)
+
+	if token == "" || isSignedToken(token) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	keyId, err := s.db.GetKeyId(token)
+	if err != nil {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	keyData, err := s.db.GetKeyDataById(keyId)
+	if err != nil {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	jsonBody, err := json.Marshal(&s3Credentials{
+		AccessKeyId:     keyId,
+		SecretAccessKey: s.keyAuth.s3Secret(keyData),
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SigningKey(secret, date, region, service string) []byte {
+	dateKey := s3Hmac([]byte("AWS4"+secret), date)
+	regionKey := s3Hmac(dateKey, region)
+	serviceKey := s3Hmac(regionKey, service)
+	return s3Hmac(serviceKey, "aws4_request")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, s3UriEncode(name, true)+"="+s3UriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func s3UriEncode(str string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3VerifyingReader checks the body against the SHA-256 from the
+// X-Amz-Content-Sha256 header once it has been fully read.
+type s3VerifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func (v *s3VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(v.hash.Sum(nil), v.expected) {
+		return n, s3ErrSha256Mismatch
+	}
+	return n, err
+}
+
+func (v *s3VerifyingReader) Close() error {
+	return v.body.Close()
+}
+
+// s3ChunkedReader decodes the aws-chunked content encoding, verifying the
+// signature of each chunk when the payload is signed.
+type s3ChunkedReader struct {
+	body    io.ReadCloser
+	reader  *bufio.Reader
+	sig     *s3Signature
+	prevSig string
+	signed  bool
+	chunk   []byte
+	done    bool
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *s3ChunkedReader) Close() error {
+	return c.body.Close()
+}
+
+func (c *s3ChunkedReader) readChunk() error {
+
+	header, err := c.reader.ReadString('\n')
+	if err != nil {
+		return errors.New("Invalid chunk header")
+	}
+
+	headerParts := strings.SplitN(strings.TrimRight(header, "\r\n"), ";", 2)
+
+	size, err := strconv.ParseInt(headerParts[0], 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return errors.New("Invalid chunk size")
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(c.reader, data)
+	if err != nil {
+		return err
+	}
+
+	if size == 0 {
+		c.done = true
+	}
+
+	if c.signed {
+		if len(headerParts) != 2 || !strings.HasPrefix(headerParts[1], "chunk-signature=") {
+			return errors.New("Missing chunk signature")
+		}
+		chunkSig := headerParts[1][len("chunk-signature="):]
+
+		dataHash := sha256.Sum256(data)
+		stringToSign := strings.Join([]string{
+			"AWS4-HMAC-SHA256-PAYLOAD",
+			c.sig.amzDate,
+			c.sig.scope,
+			c.prevSig,
+			s3EmptySha256,
+			hex.EncodeToString(dataHash[:]),
+		}, "\n")
+
+		expected := hex.EncodeToString(s3Hmac(c.sig.signingKey, stringToSign))
+		if !hmac.Equal([]byte(expected), []byte(chunkSig)) {
+			return s3ErrSignatureDoesNotMatch
+		}
+
+		c.prevSig = chunkSig
+	} else if size == 0 {
+		// Skip trailing headers, which end with an empty line
+		for {
+			line, err := c.reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line == "\r\n" {
+				return nil
+			}
+		}
+	}
+
+	crlf := make([]byte, 2)
+	_, err = io.ReadFull(c.reader, crlf)
+	if err != nil || string(crlf) != "\r\n" {
+		return errors.New("Invalid chunk terminator")
+	}
+
+	c.chunk = data
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package gemdrive
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s3Sign signs a request the way an S3 client would.
+func s3Sign(t *testing.T, req *http.Request, creds *s3Credentials, body []byte) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format("20060102")
+	scope := date + "/us-east-1/s3/aws4_request"
+
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHashHex + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3UriEncode(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := s3SigningKey(creds.SecretAccessKey, date, "us-east-1", "s3")
+	signature := hex.EncodeToString(s3Hmac(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func s3Do(t *testing.T, creds *s3Credentials, method, reqUrl string, body []byte) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, reqUrl, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3Sign(t, req, creds, body)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, _ := ioutil.ReadAll(res.Body)
+
+	return res.StatusCode, res.Header, string(resBody)
+}
+
+func getS3Credentials(t *testing.T, baseUrl, key string) *s3Credentials {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", baseUrl+"/gemdrive/s3-credentials", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatalf("Getting S3 credentials: %d", res.StatusCode)
+	}
+
+	creds := &s3Credentials{}
+	err = json.NewDecoder(res.Body).Decode(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return creds
+}
+
+func TestS3CredentialsDontRevealKey(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	creds := getS3Credentials(t, baseUrl, masterKey)
+
+	if !strings.HasPrefix(masterKey, creds.AccessKeyId+".") {
+		t.Fatalf("Access key ID %s isn't the key's ID", creds.AccessKeyId)
+	}
+
+	if strings.Contains(creds.SecretAccessKey, masterKey) || strings.Contains(masterKey, creds.SecretAccessKey) {
+		t.Fatal("Secret access key is the key itself")
+	}
+
+	status, _, _ := s3Do(t, creds, "PUT", baseUrl+"/bucket/a.txt", []byte("hello"))
+	if status != 200 {
+		t.Fatalf("PutObject: %d", status)
+	}
+
+	wrongCreds := &s3Credentials{AccessKeyId: creds.AccessKeyId, SecretAccessKey: masterKey}
+	status, _, _ = s3Do(t, wrongCreds, "GET", baseUrl+"/bucket/a.txt", nil)
+	if status != 403 {
+		t.Fatalf("Request signed with the raw key: got %d, want 403", status)
+	}
+}
+
+func TestS3CompleteMultipartUploadChecksParts(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	creds := getS3Credentials(t, baseUrl, masterKey)
+
+	objectUrl := baseUrl + "/bucket/big.bin"
+
+	status, _, body := s3Do(t, creds, "POST", objectUrl+"?uploads", nil)
+	if status != 200 {
+		t.Fatalf("CreateMultipartUpload: %d %s", status, body)
+	}
+
+	uploadId := body[strings.Index(body, "<UploadId>")+len("<UploadId>") : strings.Index(body, "</UploadId>")]
+
+	partUrl := objectUrl + "?partNumber=1&uploadId=" + url.QueryEscape(uploadId)
+	status, header, _ := s3Do(t, creds, "PUT", partUrl, []byte("part one"))
+	if status != 200 {
+		t.Fatalf("UploadPart: %d", status)
+	}
+	etag := header.Get("ETag")
+
+	complete := func(partNumber int, etag string) (int, string) {
+		reqBody := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>", partNumber, etag)
+		status, _, body := s3Do(t, creds, "POST", objectUrl+"?uploadId="+url.QueryEscape(uploadId), []byte(reqBody))
+		return status, body
+	}
+
+	otherEtag := md5.Sum([]byte("something else"))
+	status, body = complete(1, `"`+hex.EncodeToString(otherEtag[:])+`"`)
+	if status != 400 || !strings.Contains(body, "InvalidPart") {
+		t.Fatalf("Wrong ETag: got %d %s, want InvalidPart", status, body)
+	}
+
+	status, body = complete(2, etag)
+	if status != 400 || !strings.Contains(body, "InvalidPart") {
+		t.Fatalf("Wrong part number: got %d %s, want InvalidPart", status, body)
+	}
+
+	status, body = complete(1, etag)
+	if status != 200 {
+		t.Fatalf("CompleteMultipartUpload: %d %s", status, body)
+	}
+
+	status, _, body = s3Do(t, creds, "GET", objectUrl, nil)
+	if status != 200 || body != "part one" {
+		t.Fatalf("GetObject: %d %q", status, body)
+	}
+
+}
+
+func TestS3ETagsMatch(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	creds := getS3Credentials(t, baseUrl, masterKey)
+
+	objectUrl := baseUrl + "/bucket/a.txt"
+
+	status, header, _ := s3Do(t, creds, "PUT", objectUrl, []byte("hello"))
+	if status != 200 {
+		t.Fatalf("PutObject: %d", status)
+	}
+
+	etag := header.Get("ETag")
+	if etag == "" {
+		t.Fatal("PutObject: missing ETag")
+	}
+
+	for _, method := range []string{"HEAD", "GET"} {
+		status, header, _ = s3Do(t, creds, method, objectUrl, nil)
+		if status != 200 || header.Get("ETag") != etag {
+			t.Fatalf("%s: got %d %s, want %s", method, status, header.Get("ETag"), etag)
+		}
+	}
+
+	status, _, body := s3Do(t, creds, "GET", baseUrl+"/bucket?list-type=2", nil)
+	if status != 200 {
+		t.Fatalf("ListObjectsV2: %d %s", status, body)
+	}
+
+	escaped := strings.Replace(etag, `"`, "&#34;", -1)
+	if !strings.Contains(body, "<ETag>"+escaped+"</ETag>") {
+		t.Fatalf("ListObjectsV2: missing ETag %s in %s", etag, body)
+	}
+}
+
+func TestS3PutObjectBadDigestKeepsObject(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	creds := getS3Credentials(t, baseUrl, masterKey)
+
+	objectUrl := baseUrl + "/bucket/a.txt"
+
+	status, _, _ := s3Do(t, creds, "PUT", objectUrl, []byte("hello"))
+	if status != 200 {
+		t.Fatalf("PutObject: %d", status)
+	}
+
+	body := []byte("HELLO")
+	req, err := http.NewRequest("PUT", objectUrl, strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMd5 := md5.Sum([]byte("something else"))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(otherMd5[:]))
+	s3Sign(t, req, creds, body)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resBody, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != 400 || !strings.Contains(string(resBody), "BadDigest") {
+		t.Fatalf("PutObject with wrong Content-MD5: got %d %s, want BadDigest", res.StatusCode, resBody)
+	}
+
+	status, _, content := s3Do(t, creds, "GET", objectUrl, nil)
+	if status != 200 || content != "hello" {
+		t.Fatalf("GetObject after BadDigest: got %d %q", status, content)
+	}
+}
+
+func TestS3DeleteObjectsRejectsTraversal(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	creds := getS3Credentials(t, baseUrl, masterKey)
+
+	status, _, _ := s3Do(t, creds, "PUT", baseUrl+"/secret/a.txt", []byte("secret"))
+	if status != 200 {
+		t.Fatalf("PutObject: %d", status)
+	}
+
+	status, _, _ = s3Do(t, creds, "PUT", baseUrl+"/bucket/b.txt", []byte("b"))
+	if status != 200 {
+		t.Fatalf("PutObject: %d", status)
+	}
+
+	reqBody := "<Delete><Object><Key>../secret/a.txt</Key></Object></Delete>"
+	status, _, body := s3Do(t, creds, "POST", baseUrl+"/bucket?delete", []byte(reqBody))
+	if status != 200 || !strings.Contains(body, "InvalidArgument") {
+		t.Fatalf("DeleteObjects: got %d %s, want an InvalidArgument error", status, body)
+	}
+
+	status, _, content := s3Do(t, creds, "GET", baseUrl+"/secret/a.txt", nil)
+	if status != 200 || content != "secret" {
+		t.Fatalf("GetObject after DeleteObjects: got %d %q", status, content)
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/anderspitman/treemess-go"
+	"golang.org/x/net/webdav"
 )
 
 type Server struct {
@@ -29,6 +31,13 @@ type Server struct {
 	db         *GemDriveDatabase
 	keyAuth    *KeyAuth
 	handler    http.Handler
+	davLocks   webdav.LockSystem
+	tusLocks   sync.Map
+	events     *eventHub
+	watchOnce  sync.Once
+	oidc       *oidcLogin
+	audit      *auditLog
+	done       chan struct{}
 }
 
 type HttpServer interface {
@@ -44,7 +53,7 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 		config.CacheDir = filepath.Join(config.DataDir, "cache")
 	}
 
-	if len(config.Dirs) == 1 && config.RcloneDir == "" {
+	if len(config.Dirs) == 1 && config.RcloneDir == "" && len(config.MemoryDirs) == 0 && len(config.Remotes) == 0 {
 		fsBackend, err := NewFileSystemBackend(config.Dirs[0], config.CacheDir)
 		if err != nil {
 			return nil, err
@@ -65,6 +74,19 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 			multiBackend.AddBackend(filepath.Base(dir), fsBackend)
 		}
 
+		// Scratch space that's gone once the server stops
+		for _, name := range config.MemoryDirs {
+			multiBackend.AddBackend(name, NewMemoryBackend(config.MemoryDirMaxSize))
+		}
+
+		for name, remote := range config.Remotes {
+			remoteBackend, err := NewGemDriveRemoteBackend(remote.Url, remote.Key)
+			if err != nil {
+				return nil, err
+			}
+			multiBackend.AddBackend(name, remoteBackend)
+		}
+
 		if config.RcloneDir != "" {
 			rcloneBackend := NewRcloneBackend()
 			multiBackend.AddBackend(config.RcloneDir, rcloneBackend)
@@ -73,19 +95,22 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 		backend = multiBackend
 	}
 
-	db, err := NewGemDriveDatabase(config.DataDir)
+	store, err := OpenStore(config.DataDir, config.DbStore)
 	if err != nil {
 		return nil, err
 	}
 
-	masterKey, err := db.GetMasterKey()
+	db, err := NewGemDriveDatabase(store)
 	if err != nil {
-		fmt.Println("No master key found. Shouldn't be possible")
+		return nil, err
 	}
 
-	fmt.Println("Master key: " + masterKey)
+	keyAuth, err := NewKeyAuth(db, config.DataDir)
+	if err != nil {
+		return nil, err
+	}
 
-	keyAuth, err := NewKeyAuth(db)
+	audit, err := newAuditLog(filepath.Join(config.DataDir, "audit.log"), config.AuditMaxSize, config.AuditMaxFiles)
 	if err != nil {
 		return nil, err
 	}
@@ -93,13 +118,37 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 	mux := &http.ServeMux{}
 
 	server := &Server{
-		tmess:   tmess,
-		state:   "stopped",
-		config:  config,
-		backend: backend,
-		keyAuth: keyAuth,
-		db:      db,
-		handler: mux,
+		tmess:     tmess,
+		state:     "stopped",
+		config:    config,
+		backend:   backend,
+		loginHtml: []byte(loginPageHtml),
+		keyAuth:   keyAuth,
+		db:        db,
+		handler:   mux,
+		davLocks:  webdav.NewMemLS(),
+		events:    newEventHub(),
+		audit:     audit,
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				server.pruneTusUploads()
+			case <-server.done:
+				return
+			}
+		}
+	}()
+
+	if config.Oidc != nil {
+		server.oidc = newOidcLogin(config.Oidc)
+		server.loginHtml = []byte(strings.Replace(loginPageHtml, "<!-- oidc -->", oidcLoginHtml, 1))
 	}
 
 	tmess.ListenFunc(func(msg treemess.Message) {
@@ -146,12 +195,16 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 		//header["Access-Control-Allow-Credentials"] = []string{"true"}
 		header["Access-Control-Allow-Methods"] = []string{"*"}
 		header["Access-Control-Allow-Headers"] = []string{"*"}
-		if r.Method == "OPTIONS" {
-			return
-		}
 
 		reqPath := r.URL.Path
 
+		// WebDAV and tus clients use OPTIONS to discover capabilities
+		isWebDav := reqPath == webdavPrefix || strings.HasPrefix(reqPath, webdavPrefix+"/")
+		isTus := strings.HasPrefix(reqPath, tusPrefix)
+		if r.Method == "OPTIONS" && !isWebDav && !isTus {
+			return
+		}
+
 		hostname := r.Header.Get("X-Forwarded-Host")
 		if hostname == "" {
 			hostname = r.Host
@@ -165,6 +218,26 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 		logLine := fmt.Sprintf("%s\t%s\t%s", r.Method, hostname, reqPath)
 		fmt.Println(logLine)
 
+		auditWriter, r := s.beginAudit(w, r, mappedRoot)
+		defer s.endAudit(auditWriter, r, time.Now())
+		w = auditWriter
+
+		// S3 requests count their own use once the signature is checked
+		if token, err := extractToken(r); err == nil && !isS3Request(r) {
+			if isSignedToken(token) && !s.checkSignedRequest(w, r, token) {
+				return
+			}
+
+			if reqPath != "/gemdrive/login" && !s.checkCsrf(w, r, token) {
+				return
+			}
+
+			if !s.keyAuth.ReserveUse(token) {
+				s.sendUnauthorized(w, r)
+				return
+			}
+		}
+
 		ext := path.Ext(reqPath)
 		contentType := mime.TypeByExtension(ext)
 		header.Set("Content-Type", contentType)
@@ -172,6 +245,8 @@ func NewServer(config *Config, tmess *treemess.TreeMess) (*Server, error) {
 		if hostname == s.config.DashboardDomain {
 			io.WriteString(w, "<h1>GemDrive Dashboard</h1>")
 			return
+		} else if isS3Request(r) {
+			s.handleS3(w, r, mappedRoot)
 		} else if strings.HasPrefix(reqPath, "/gemdrive/") {
 			s.handleGemDriveRequest(w, r, reqPath, mappedRoot)
 		} else {
@@ -258,6 +333,22 @@ func (s *Server) stop() {
 	}
 }
 
+// Close stops the server's background work, writes out the rest of the
+// audit log and closes the database. It doesn't stop serving requests;
+// that's up to whoever is serving them, and it has to happen first.
+func (s *Server) Close() error {
+	close(s.done)
+
+	auditErr := s.audit.Close()
+
+	err := s.db.Close()
+	if err != nil {
+		return err
+	}
+
+	return auditErr
+}
+
 func (s *Server) handleHead(w http.ResponseWriter, r *http.Request, reqPath string) {
 
 	token, _ := extractToken(r)
@@ -273,6 +364,10 @@ func (s *Server) handleHead(w http.ResponseWriter, r *http.Request, reqPath stri
 		return
 	}
 
+	if !s.checkPreconditions(w, r, reqPath) {
+		return
+	}
+
 	parentDir := filepath.Dir(reqPath) + "/"
 
 	item, err := s.backend.List(parentDir, 1)
@@ -304,6 +399,54 @@ func (s *Server) handleHead(w http.ResponseWriter, r *http.Request, reqPath stri
 
 	header.Set("Last-Modified", modTime.Format(http.TimeFormat))
 	header.Set("Content-Length", fmt.Sprintf("%d", child.Size))
+
+	s.setValidatorHeaders(w, reqPath, child)
+}
+
+// statItem looks up the metadata for a single file or directory by listing
+// its parent.
+func statItem(backend Backend, reqPath string) (*Item, bool, error) {
+
+	trimmed := strings.TrimSuffix(reqPath, "/")
+
+	if trimmed == "" {
+		item, err := backend.List("/", 1)
+		return item, true, err
+	}
+
+	parentDir := path.Dir(trimmed)
+	if parentDir != "/" {
+		parentDir += "/"
+	}
+
+	parent, err := backend.List(parentDir, 1)
+	if _, ok := err.(*Error); ok {
+		return nil, false, err
+	} else if err != nil {
+		// Not all backends return a proper *Error when the parent
+		// doesn't exist.
+		return nil, false, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	name := path.Base(trimmed)
+
+	if child, exists := parent.Children[name+"/"]; exists {
+		return child, true, nil
+	}
+
+	if !strings.HasSuffix(reqPath, "/") {
+		if child, exists := parent.Children[name]; exists {
+			return child, false, nil
+		}
+	}
+
+	return nil, false, &Error{
+		HttpCode: 404,
+		Message:  "Not found",
+	}
 }
 
 func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath string) {
@@ -316,7 +459,15 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath strin
 
 	query := r.URL.Query()
 
-	if !s.keyAuth.CanWrite(token, reqPath) {
+	isDir := strings.HasSuffix(reqPath, "/")
+	overwrite := query.Get("overwrite") == "true"
+
+	eventType := "create"
+	if !isDir {
+		eventType = s.writeEventType(reqPath, overwrite)
+	}
+
+	if !s.keyAuth.Can(token, reqPath, writePerm(eventType)) {
 		s.sendUnauthorized(w, r)
 		return
 	}
@@ -329,20 +480,33 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath strin
 		return
 	}
 
-	isDir := strings.HasSuffix(reqPath, "/")
+	if !s.checkPreconditions(w, r, reqPath) {
+		return
+	}
 
 	if isDir {
+		extract := query.Get("extract")
+		if extract != "" {
+			s.extractArchive(w, r, reqPath, extract, backend)
+			return
+		}
+
 		recursive := query.Get("recursive") == "true"
 		err := backend.MakeDir(reqPath, recursive)
-		if err != nil {
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			w.Write([]byte(e.Message))
+			return
+		} else if err != nil {
 			w.WriteHeader(400)
 			io.WriteString(w, err.Error())
 			return
 		}
+
+		s.emit("create", reqPath)
 	} else {
 		var offset int64 = 0
 		truncate := true
-		overwrite := query.Get("overwrite") == "true"
 
 		// TODO: consider allowing 0-length files
 		if r.ContentLength < 1 {
@@ -352,14 +516,29 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath strin
 		}
 
 		err := backend.Write(reqPath, r.Body, offset, r.ContentLength, overwrite, truncate)
-		if err != nil {
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			w.Write([]byte(e.Message))
+			return
+		} else if err != nil {
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
 		}
 
 		s.setAttrs(w, r, reqPath, backend)
+
+		s.emit(eventType, reqPath)
+	}
+}
+
+// writePerm returns the permissions needed for a write, given whether it
+// creates a new file or replaces an existing one.
+func writePerm(eventType string) string {
+	if eventType == "modify" {
+		return "create,delete"
 	}
+	return "create"
 }
 
 func (s *Server) setAttrs(w http.ResponseWriter, r *http.Request, reqPath string, backend WritableBackend) {
@@ -369,15 +548,25 @@ func (s *Server) setAttrs(w http.ResponseWriter, r *http.Request, reqPath string
 	isExecutable := query.Get("is-executable") == "true"
 
 	if modTimeStr != "" || isExecutable {
-		modTime, err := time.Parse("2006-01-02T15:04:05Z", modTimeStr)
-		if err != nil {
-			w.WriteHeader(500)
-			io.WriteString(w, err.Error())
-			return
+		// This is right after a write, so if no mod time was given it's
+		// now.
+		modTime := time.Now()
+		if modTimeStr != "" {
+			var err error
+			modTime, err = time.Parse("2006-01-02T15:04:05Z", modTimeStr)
+			if err != nil {
+				w.WriteHeader(400)
+				io.WriteString(w, "Invalid mod-time")
+				return
+			}
 		}
 
-		err = backend.SetAttributes(reqPath, modTime, isExecutable)
-		if err != nil {
+		err := backend.SetAttributes(reqPath, modTime, isExecutable)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			w.Write([]byte(e.Message))
+			return
+		} else if err != nil {
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
@@ -395,22 +584,6 @@ func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, reqPath str
 
 	query := r.URL.Query()
 
-	if !s.keyAuth.CanWrite(token, reqPath) {
-		s.sendUnauthorized(w, r)
-		return
-	}
-
-	backend, ok := s.backend.(WritableBackend)
-
-	if !ok {
-		w.WriteHeader(500)
-		io.WriteString(w, "Backend does not support writing")
-		return
-	}
-
-	overwrite := true
-	truncate := false
-
 	offsetParam := query.Get("offset")
 
 	var offset int
@@ -427,6 +600,38 @@ func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, reqPath str
 		}
 	}
 
+	// Writing past the end only needs append. Anything else can
+	// change existing data.
+	perm := "create"
+	item, _, err := statItem(s.backend, reqPath)
+	if err == nil {
+		if int64(offset) == item.Size {
+			perm = "append"
+		} else {
+			perm = "create,delete"
+		}
+	}
+
+	if !s.keyAuth.Can(token, reqPath, perm) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support writing")
+		return
+	}
+
+	if !s.checkPreconditions(w, r, reqPath) {
+		return
+	}
+
+	overwrite := true
+	truncate := false
+
 	size, err := strconv.Atoi(r.Header.Get("Content-Length"))
 	if err != nil {
 		w.WriteHeader(400)
@@ -435,13 +640,19 @@ func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, reqPath str
 	}
 
 	err = backend.Write(reqPath, r.Body, int64(offset), int64(size), overwrite, truncate)
-	if err != nil {
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	} else if err != nil {
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
 		return
 	}
 
 	s.setAttrs(w, r, reqPath, backend)
+
+	s.emit("modify", reqPath)
 }
 
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, reqPath string) {
@@ -453,7 +664,7 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, reqPath st
 
 	query := r.URL.Query()
 
-	if !s.keyAuth.CanWrite(token, reqPath) {
+	if !s.keyAuth.CanRecursive(token, reqPath, "delete") {
 		s.sendUnauthorized(w, r)
 		return
 	}
@@ -466,6 +677,10 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, reqPath st
 		return
 	}
 
+	if !s.checkPreconditions(w, r, reqPath) {
+		return
+	}
+
 	recursive := query.Get("recursive") == "true"
 	err := backend.Delete(reqPath, recursive)
 	if e, ok := err.(*Error); ok {
@@ -477,9 +692,18 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, reqPath st
 		io.WriteString(w, err.Error())
 		return
 	}
+
+	s.emit("delete", reqPath)
 }
 
 func (s *Server) sendUnauthorized(w http.ResponseWriter, r *http.Request) {
+
+	// Give people browsing the chance to log in
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		s.serveLoginPage(w, r, 403)
+		return
+	}
+
 	header := w.Header()
 	// Need to remove content type in case it's set
 	header.Del("Content-Type")
@@ -509,11 +733,105 @@ func (s *Server) handleGemDriveRequest(w http.ResponseWriter, r *http.Request, r
 		return
 	}
 
+	if gemReq == "/login" {
+		if r.Method == "POST" {
+			s.login(w, r)
+		} else {
+			s.serveLoginPage(w, r, 200)
+		}
+		return
+	}
+
+	if r.Method == "GET" && s.oidc != nil && gemReq == "/oidc/login" {
+		s.oidcLogin(w, r)
+		return
+	}
+
+	if r.Method == "GET" && s.oidc != nil && gemReq == "/oidc/callback" {
+		s.oidcCallback(w, r)
+		return
+	}
+
+	if r.Method == "POST" && gemReq == "/logout" {
+		s.logout(w, r)
+		return
+	}
+
+	if r.Method == "PUT" && strings.HasPrefix(gemReq, "/users/") {
+		s.setUser(w, r, gemReq[len("/users/"):])
+		return
+	}
+
+	if r.Method == "DELETE" && strings.HasPrefix(gemReq, "/users/") {
+		s.deleteUser(w, r, gemReq[len("/users/"):])
+		return
+	}
+
+	if r.Method == "GET" && gemReq == "/audit" {
+		s.serveAudit(w, r)
+		return
+	}
+
+	if r.Method == "GET" && gemReq == "/s3-credentials" {
+		s.serveS3Credentials(w, r)
+		return
+	}
+
+	if r.Method == "POST" && gemReq == "/sign" {
+		s.signUrl(w, r, mappedRoot)
+		return
+	}
+
+	if gemReq == "/webdav" || strings.HasPrefix(gemReq, "/webdav/") {
+		s.handleWebDav(w, r, mappedRoot)
+		return
+	}
+
+	if r.Method == "GET" && (gemReq == "/events" || strings.HasPrefix(gemReq, "/events/")) {
+		s.serveEvents(w, r, mappedRoot)
+		return
+	}
+
+	if strings.HasPrefix(gemReq, "/tus/") {
+		s.handleTus(w, r, mappedRoot)
+		return
+	}
+
+	if r.Method == "POST" && gemReq == "/copy" {
+		s.copy(w, r, mappedRoot)
+		return
+	}
+
+	if r.Method == "POST" && gemReq == "/move" {
+		s.move(w, r, mappedRoot)
+		return
+	}
+
+	if r.Method == "POST" && gemReq == "/set-attributes" {
+		s.setAttributes(w, r, mappedRoot)
+		return
+	}
+
 	if r.Method == "POST" && strings.HasPrefix(gemReq, "/remote-get") {
 		s.remoteGet(w, r)
 		return
 	}
 
+	if r.Method == "GET" && gemReq == "/keys/" {
+		s.listKeys(w, r)
+		return
+	}
+
+	if r.Method == "GET" && strings.HasPrefix(gemReq, "/keys/") {
+		s.getKey(w, r, gemReq[len("/keys/"):])
+		return
+	}
+
+	if r.Method == "DELETE" && strings.HasPrefix(gemReq, "/keys/") {
+		s.revokeKey(w, r, gemReq[len("/keys/"):])
+		return
+	}
+
 	if r.Method == "PUT" && strings.HasPrefix(gemReq, "/keys/") {
 
 		pathParts := strings.Split(gemReq, "/")
@@ -553,7 +871,7 @@ func (s *Server) handleGemDriveRequest(w http.ResponseWriter, r *http.Request, r
 
 		gemPath := mappedRoot + gemReq[len("/index"):len(gemReq)-len(suffix)]
 
-		if !s.keyAuth.CanRead(token, gemPath) {
+		if !s.keyAuth.Can(token, gemPath, "list") {
 			s.sendUnauthorized(w, r)
 			return
 		}
@@ -569,6 +887,35 @@ func (s *Server) handleGemDriveRequest(w http.ResponseWriter, r *http.Request, r
 			return
 		}
 
+		s.filterListing(token, gemPath, item)
+
+		hashAlgorithm := r.URL.Query().Get("hash")
+		if hashAlgorithm != "" {
+			if hashAlgorithm != HashSha256 {
+				w.WriteHeader(400)
+				io.WriteString(w, "Unsupported hash algorithm. Only "+HashSha256+" is supported.")
+				return
+			}
+
+			hasher, ok := s.backend.(Hasher)
+			if !ok {
+				w.WriteHeader(400)
+				io.WriteString(w, "Backend does not support hashing")
+				return
+			}
+
+			err := addHashes(hasher, gemPath, item, hashAlgorithm)
+			if e, ok := err.(*Error); ok {
+				w.WriteHeader(e.HttpCode)
+				w.Write([]byte(e.Message))
+				return
+			} else if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
 		jsonBody, err := json.Marshal(item)
 		//jsonBody, err := json.MarshalIndent(item, "", "  ")
 		if err != nil {
@@ -601,7 +948,11 @@ func (s *Server) handleGemDriveRequest(w http.ResponseWriter, r *http.Request, r
 
 				imagePath := gemPath
 				img, _, err := b.GetImage(imagePath, size)
-				if err != nil {
+				if e, ok := err.(*Error); ok {
+					w.WriteHeader(e.HttpCode)
+					w.Write([]byte(e.Message))
+					return
+				} else if err != nil {
 					w.WriteHeader(500)
 					w.Write([]byte(err.Error()))
 					return
@@ -620,6 +971,27 @@ func (s *Server) handleGemDriveRequest(w http.ResponseWriter, r *http.Request, r
 	}
 }
 
+// filterListing removes the entries the key has no permissions for at all,
+// and the contents of subdirectories it isn't allowed to list.
+func (s *Server) filterListing(token, dirPath string, item *Item) {
+	for name, child := range item.Children {
+		childPath := dirPath + name
+
+		if !s.keyAuth.CanAccess(token, childPath) {
+			delete(item.Children, name)
+			continue
+		}
+
+		if child.Children != nil {
+			if s.keyAuth.Can(token, childPath, "list") {
+				s.filterListing(token, childPath, child)
+			} else {
+				child.Children = nil
+			}
+		}
+	}
+}
+
 func (s *Server) checkNewKeyRequest(w http.ResponseWriter, r *http.Request, parentKey string) (*KeyData, error) {
 
 	bodyJson, err := ioutil.ReadAll(r.Body)
@@ -638,10 +1010,62 @@ func (s *Server) checkNewKeyRequest(w http.ResponseWriter, r *http.Request, pare
 		return nil, err
 	}
 
-	if !reqKeyData.IsSubsetOf(parentKeyData) {
+	if !parentKeyData.IsValid() {
+		return nil, errors.New("Key is expired or not yet valid")
+	}
+
+	if !reqKeyData.IsSubsetOf(parentKeyData.Delegatable()) {
 		return nil, errors.New("You don't have permissions for that")
 	}
 
+	reqKeyData.Uses = 0
+	reqKeyData.Session = false
+
+	if reqKeyData.MaxUses < 0 {
+		return nil, errors.New("Invalid maxUses")
+	}
+
+	var notBefore, expiresAt time.Time
+
+	if reqKeyData.NotBefore != "" {
+		notBefore, err = time.Parse(time.RFC3339, reqKeyData.NotBefore)
+		if err != nil {
+			return nil, errors.New("Invalid notBefore")
+		}
+	}
+
+	if reqKeyData.ExpiresAt != "" {
+		expiresAt, err = time.Parse(time.RFC3339, reqKeyData.ExpiresAt)
+		if err != nil {
+			return nil, errors.New("Invalid expiresAt")
+		}
+	}
+
+	// A child key can't be valid at any time its parent isn't
+	if parentKeyData.ExpiresAt != "" {
+		parentExpiresAt, _ := time.Parse(time.RFC3339, parentKeyData.ExpiresAt)
+
+		if reqKeyData.ExpiresAt == "" {
+			reqKeyData.ExpiresAt = parentKeyData.ExpiresAt
+			expiresAt = parentExpiresAt
+		} else if expiresAt.After(parentExpiresAt) {
+			return nil, errors.New("Key can't expire after its parent")
+		}
+	}
+
+	if parentKeyData.NotBefore != "" {
+		parentNotBefore, _ := time.Parse(time.RFC3339, parentKeyData.NotBefore)
+
+		if reqKeyData.NotBefore == "" || notBefore.Before(parentNotBefore) {
+			reqKeyData.NotBefore = parentKeyData.NotBefore
+			notBefore = parentNotBefore
+		}
+	}
+
+	if !expiresAt.IsZero() && !notBefore.IsZero() && !notBefore.Before(expiresAt) {
+		return nil, errors.New("notBefore must be before expiresAt")
+	}
+
 	return reqKeyData, nil
 }
 
@@ -656,34 +1080,54 @@ func (s *Server) createKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newKey, _ := genRandomKey()
+	newKey, err := genKey()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
 
-	reqKeyData.Parent = parentKey
+	reqKeyData.Parent, err = s.db.GetKeyId(parentKey)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
 
-	s.db.SetKeyData(newKey, reqKeyData)
+	_, err = s.db.SetKeyData(newKey, reqKeyData)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
 
 	io.WriteString(w, newKey)
 }
 
 func (s *Server) setKey(w http.ResponseWriter, r *http.Request, key string) {
 
-	fmt.Println("key", key)
-
 	reqKey, _ := extractToken(r)
 
-	masterKey, err := s.db.GetMasterKey()
+	masterKeyId, err := s.db.GetMasterKeyId()
 	if err != nil {
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
 		return
 	}
 
-	if reqKey != masterKey {
+	reqKeyId, err := s.db.GetKeyId(reqKey)
+	if err != nil || reqKeyId != masterKeyId {
 		w.WriteHeader(400)
 		io.WriteString(w, "Only the master key can set keys")
 		return
 	}
 
+	if id, _ := splitKeyId(key); id == masterKeyId {
+		w.WriteHeader(400)
+		io.WriteString(w, "Can't replace the master key")
+		return
+	}
+
 	reqKeyData, err := s.checkNewKeyRequest(w, r, reqKey)
 	if err != nil {
 		w.WriteHeader(500)
@@ -691,9 +1135,14 @@ func (s *Server) setKey(w http.ResponseWriter, r *http.Request, key string) {
 		return
 	}
 
-	reqKeyData.Parent = reqKey
+	reqKeyData.Parent = masterKeyId
 
-	s.db.SetKeyData(key, reqKeyData)
+	_, err = s.db.SetKeyData(key, reqKeyData)
+	if err != nil {
+		w.WriteHeader(409)
+		io.WriteString(w, err.Error())
+		return
+	}
 }
 
 func (s *Server) serveItem(w http.ResponseWriter, r *http.Request, reqPath string) {
@@ -714,11 +1163,21 @@ func (s *Server) serveItem(w http.ResponseWriter, r *http.Request, reqPath strin
 	if isDir {
 		s.serveDir(w, r, reqPath)
 	} else {
+		if !s.checkPreconditions(w, r, reqPath) {
+			return
+		}
+
 		s.serveFile(w, r, reqPath)
 	}
 }
 
 func (s *Server) serveDir(w http.ResponseWriter, r *http.Request, reqPath string) {
+	archiveFormat := r.URL.Query().Get("archive")
+	if archiveFormat != "" {
+		s.serveArchive(w, r, reqPath, archiveFormat)
+		return
+	}
+
 	// If the directory contains an index.html file, serve that by default.
 	// Otherwise reading a directory is an error.
 	htmlIndexPath := reqPath + "index.html"
@@ -753,6 +1212,15 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 
 	rangeHeader := r.Header.Get("Range")
 
+	// If the file changed since the client got the first part, send the
+	// whole thing.
+	if rangeHeader != "" && r.Header.Get("If-Range") != "" {
+		item, _, err := statItem(s.backend, reqPath)
+		if err == nil && !s.ifRangeMatches(r, reqPath, item) {
+			rangeHeader = ""
+		}
+	}
+
 	var offset int64 = 0
 	var copyLength int64 = 0
 
@@ -786,19 +1254,6 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 	}
 	defer data.Close()
 
-	if rang != nil {
-		end := rang.End
-		if end == MAX_INT64 {
-			end = item.Size - 1
-		}
-		l := end - rang.Start + 1
-		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rang.Start, end, item.Size))
-		header.Set("Content-Length", fmt.Sprintf("%d", l))
-		w.WriteHeader(206)
-	} else {
-		header.Set("Content-Length", fmt.Sprintf("%d", item.Size))
-	}
-
 	modTime, err := time.Parse("2006-01-02T15:04:05Z", item.ModTime)
 	if err != nil {
 		w.WriteHeader(500)
@@ -813,6 +1268,21 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 	}
 	header.Set("GemDrive-IsExecutable", isExecutableHeader)
 
+	s.setValidatorHeaders(w, reqPath, item)
+
+	if rang != nil {
+		end := rang.End
+		if end == MAX_INT64 || end >= item.Size {
+			end = item.Size - 1
+		}
+		l := end - rang.Start + 1
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rang.Start, end, item.Size))
+		header.Set("Content-Length", fmt.Sprintf("%d", l))
+		w.WriteHeader(206)
+	} else {
+		header.Set("Content-Length", fmt.Sprintf("%d", item.Size))
+	}
+
 	_, err = io.Copy(w, data)
 	if err != nil {
 		fmt.Println(err)
@@ -879,8 +1349,16 @@ func extractToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 
 	if authHeader != "" {
-		tokenHeader := strings.Split(authHeader, " ")[1]
-		return tokenHeader, nil
+		// For HTTP basic auth (used by WebDAV clients) the password is
+		// the token and the username is ignored.
+		if _, password, ok := r.BasicAuth(); ok {
+			return password, nil
+		}
+
+		authParts := strings.Split(authHeader, " ")
+		if len(authParts) == 2 {
+			return authParts[1], nil
+		}
 	}
 
 	tokenCookie, err := r.Cookie(tokenName)
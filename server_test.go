@@ -0,0 +1,81 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anderspitman/treemess-go"
+)
+
+// newTestServer starts a server for a temporary directory, and returns it
+// along with its URL and master key.
+func newTestServer(t testing.TB) (*Server, string, string) {
+	t.Helper()
+
+	tmpDir := t.TempDir()
+
+	driveDir := filepath.Join(tmpDir, "drive")
+	dataDir := filepath.Join(tmpDir, "data")
+
+	for _, dir := range []string{driveDir, dataDir} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:    []string{driveDir},
+		DataDir: dataDir,
+	}, treemess.NewTreeMess())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleanups run last to first, so this happens after the HTTP server
+	// has shut down
+	t.Cleanup(func() { server.Close() })
+
+	masterKey, err := server.db.RotateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	return server, httpServer.URL, masterKey
+}
+
+// doRequest makes a request with key as a bearer token, if given, and
+// returns the status and body.
+func doRequest(t testing.TB, method, reqUrl, key, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, reqUrl, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, string(resBody)
+}
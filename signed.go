@@ -0,0 +1,288 @@
+package gemdrive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Signed URLs let a key holder share access to a single path without
+// creating a new key. The token carries what it's good for, and is checked
+// against an HMAC instead of the database.
+//
+// The HMAC secret is derived from the signing key's salt, so revoking or
+// rotating a key also invalidates every URL it signed. It's mixed with a
+// server secret kept outside the database, so a leaked database isn't
+// enough to forge them. Requests made with them count towards the signing
+// key's usage limit.
+
+const signedTokenPrefix = "sig."
+
+const defaultSignedUrlLifetime = time.Hour
+
+type signedUrl struct {
+	KeyId     string `json:"k"`
+	Path      string `json:"p"`
+	Method    string `json:"m"`
+	ExpiresAt int64  `json:"e"`
+	Range     string `json:"r,omitempty"`
+}
+
+func isSignedToken(token string) bool {
+	return strings.HasPrefix(token, signedTokenPrefix)
+}
+
+// methodPerms returns the most a signed URL for the given method can do.
+func methodPerms(method string) permSet {
+	switch method {
+	case "GET", "HEAD":
+		return permRead
+	case "PUT":
+		return permCreate | permDelete
+	case "PATCH":
+		return permCreate | permAppend | permDelete
+	case "DELETE":
+		return permDelete
+	}
+	return 0
+}
+
+func loadSigningSecret(dir string) ([]byte, error) {
+	secretPath := filepath.Join(dir, "signing_secret")
+
+	secret, err := ioutil.ReadFile(secretPath)
+	if err == nil && len(secret) > 0 {
+		return secret, nil
+	}
+
+	key, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(secretPath, []byte(key), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(key), nil
+}
+
+func (a *KeyAuth) keySecret(keyData *KeyData) []byte {
+	mac := hmac.New(sha256.New, a.signingSecret)
+	mac.Write([]byte(keyData.Salt))
+	return mac.Sum(nil)
+}
+
+func (a *KeyAuth) signature(keyData *KeyData, payload string) string {
+	mac := hmac.New(sha256.New, a.keySecret(keyData))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign creates a signed token on behalf of key. The key needs at least one of
+// the permissions the method calls for on the path.
+func (a *KeyAuth) Sign(key string, u *signedUrl) (string, error) {
+
+	id, err := a.db.GetKeyId(key)
+	if err != nil {
+		return "", &Error{403, "Unauthorized"}
+	}
+
+	keyData, err := a.db.GetKeyDataById(id)
+	if err != nil || !keyData.IsValid() {
+		return "", &Error{403, "Unauthorized"}
+	}
+
+	if keyData.perms(u.Path)&methodPerms(u.Method) == 0 {
+		return "", &Error{403, "Unauthorized"}
+	}
+
+	u.KeyId = id
+
+	payloadJson, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(payloadJson)
+
+	return signedTokenPrefix + payload + "." + a.signature(keyData, payload), nil
+}
+
+// verifySigned checks a signed token's signature and expiration, and returns
+// it along with the data of the key that signed it.
+func (a *KeyAuth) verifySigned(token string) (*signedUrl, *KeyData, error) {
+
+	parts := strings.Split(strings.TrimPrefix(token, signedTokenPrefix), ".")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Invalid signed URL")
+	}
+
+	payload, sig := parts[0], parts[1]
+
+	payloadJson, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, nil, errors.New("Invalid signed URL")
+	}
+
+	u := &signedUrl{}
+	err = json.Unmarshal(payloadJson, u)
+	if err != nil {
+		return nil, nil, errors.New("Invalid signed URL")
+	}
+
+	keyData, err := a.db.GetKeyDataById(u.KeyId)
+	if err != nil {
+		return nil, nil, errors.New("Invalid signed URL")
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(a.signature(keyData, payload))) {
+		return nil, nil, errors.New("Invalid signed URL")
+	}
+
+	if !time.Now().Before(time.Unix(u.ExpiresAt, 0)) {
+		return nil, nil, errors.New("Signed URL expired")
+	}
+
+	if !keyData.IsValid() {
+		return nil, nil, errors.New("Invalid signed URL")
+	}
+
+	return u, keyData, nil
+}
+
+func (s *Server) signUrl(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+
+	token, _ := extractToken(r)
+
+	if token == "" || isSignedToken(token) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	var signReq SignRequest
+	err = json.Unmarshal(bodyJson, &signReq)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if !strings.HasPrefix(signReq.Path, "/") {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid path")
+		return
+	}
+
+	method := strings.ToUpper(signReq.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	if methodPerms(method) == 0 {
+		w.WriteHeader(400)
+		io.WriteString(w, "Unsupported method")
+		return
+	}
+
+	if signReq.Range != "" {
+		if method != "GET" {
+			w.WriteHeader(400)
+			io.WriteString(w, "Range is only supported for GET")
+			return
+		}
+
+		_, err := parseRange(signReq.Range)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(defaultSignedUrlLifetime)
+	if signReq.ExpiresAt != "" {
+		expiresAt, err = time.Parse(time.RFC3339, signReq.ExpiresAt)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid expiresAt")
+			return
+		}
+
+		if !time.Now().Before(expiresAt) {
+			w.WriteHeader(400)
+			io.WriteString(w, "expiresAt is in the past")
+			return
+		}
+	}
+
+	signed, err := s.keyAuth.Sign(token, &signedUrl{
+		Path:      mappedRoot + signReq.Path,
+		Method:    method,
+		ExpiresAt: expiresAt.Unix(),
+		Range:     signReq.Range,
+	})
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	signedPath := (&url.URL{Path: signReq.Path}).EscapedPath()
+
+	io.WriteString(w, signedPath+"?access_token="+signed)
+}
+
+// checkSignedRequest makes sure a request made with a signed token matches
+// the method and range that were signed. The path is checked by KeyAuth.
+func (s *Server) checkSignedRequest(w http.ResponseWriter, r *http.Request, token string) bool {
+
+	u, _, err := s.keyAuth.verifySigned(token)
+	if err != nil {
+		w.WriteHeader(403)
+		io.WriteString(w, err.Error())
+		return false
+	}
+
+	if r.Method != u.Method && !(r.Method == "HEAD" && u.Method == "GET") {
+		w.WriteHeader(403)
+		io.WriteString(w, "Signed URL is not valid for "+r.Method)
+		return false
+	}
+
+	if u.Range != "" {
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader != "" && rangeHeader != u.Range {
+			w.WriteHeader(403)
+			io.WriteString(w, "Signed URL is not valid for this range")
+			return false
+		}
+
+		// If-Range could otherwise turn this into a full download
+		r.Header.Set("Range", u.Range)
+		r.Header.Del("If-Range")
+	}
+
+	return true
+}
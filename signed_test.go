@@ -0,0 +1,38 @@
+package gemdrive
+
+import (
+	"testing"
+)
+
+func TestSignedUrlsCountAgainstSigner(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "hello")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	status, key := doRequest(t, "POST", baseUrl+"/gemdrive/create-key", masterKey,
+		`{"privileges": {"/": "read"}, "maxUses": 2}`)
+	if status != 200 {
+		t.Fatalf("Creating key: %d %s", status, key)
+	}
+
+	// The first use
+	status, signedPath := doRequest(t, "POST", baseUrl+"/gemdrive/sign", key, `{"path": "/a.txt"}`)
+	if status != 200 {
+		t.Fatalf("Signing: %d %s", status, signedPath)
+	}
+
+	// The second
+	status, body := doRequest(t, "GET", baseUrl+signedPath, "", "")
+	if status != 200 || body != "hello" {
+		t.Fatalf("First signed request: %d %q", status, body)
+	}
+
+	status, _ = doRequest(t, "GET", baseUrl+signedPath, "", "")
+	if status != 403 {
+		t.Fatalf("Signed request past the signer's limit: got %d, want 403", status)
+	}
+}
@@ -0,0 +1,103 @@
+package gemdrive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Store persists the keys and users in a GemDriveDatabase. The database
+// keeps everything in memory and only goes to the store to load it at
+// startup and to save changes.
+type Store interface {
+	Load() (*StoreData, error)
+	// Commit saves a set of changes. Either all of them are saved or
+	// none are.
+	Commit(changes *StoreChanges) error
+	Close() error
+}
+
+// Version is the format of the stored data, which GemDriveDatabase uses to
+// know which migrations still need running.
+type StoreData struct {
+	Version int                  `json:"version,omitempty"`
+	Keys    map[string]*KeyData  `json:"keys"`
+	Users   map[string]*UserData `json:"users,omitempty"`
+}
+
+// A Version of 0 leaves the stored version as it is.
+type StoreChanges struct {
+	Version     int
+	PutKeys     map[string]*KeyData
+	DeleteKeys  []string
+	PutUsers    map[string]*UserData
+	DeleteUsers []string
+}
+
+func newStoreChanges() *StoreChanges {
+	return &StoreChanges{
+		PutKeys:  make(map[string]*KeyData),
+		PutUsers: make(map[string]*UserData),
+	}
+}
+
+func (c *StoreChanges) isEmpty() bool {
+	return c.Version == 0 && len(c.PutKeys) == 0 && len(c.DeleteKeys) == 0 && len(c.PutUsers) == 0 && len(c.DeleteUsers) == 0
+}
+
+// OpenStore opens the store of the given type in dir. The types are "json",
+// the default, which keeps everything in a single file that's rewritten on
+// every change, and "bolt", an embedded database better suited to many keys
+// or keys with usage limits. A new bolt store imports the JSON file if there
+// is one.
+func OpenStore(dir, storeType string) (Store, error) {
+
+	jsonPath := filepath.Join(dir, "gemdrive_db.json")
+
+	switch storeType {
+	case "", "json":
+		return NewJsonStore(jsonPath), nil
+	case "bolt":
+		boltPath := filepath.Join(dir, "gemdrive_db.bolt")
+
+		_, err := os.Stat(boltPath)
+		isNew := os.IsNotExist(err)
+
+		store, err := NewBoltStore(boltPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if isNew {
+			err = importStore(store, NewJsonStore(jsonPath))
+			if err != nil {
+				store.Close()
+				os.Remove(boltPath)
+				return nil, err
+			}
+		}
+
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("Unknown store type: %s", storeType)
+}
+
+func importStore(dst, src Store) error {
+
+	data, err := src.Load()
+	if err != nil {
+		return err
+	}
+
+	changes := newStoreChanges()
+	changes.Version = data.Version
+	changes.PutKeys = data.Keys
+	changes.PutUsers = data.Users
+
+	if changes.isEmpty() {
+		return nil
+	}
+
+	return dst.Commit(changes)
+}
@@ -0,0 +1,460 @@
+package gemdrive
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Implements the core tus 1.0.0 resumable upload protocol along with the
+// creation and termination extensions. See https://tus.io/protocols/resumable-upload.html
+//
+// The destination is passed in the Upload-Metadata header as "path". If it
+// ends with a slash, "filename" is appended to it. Optional "overwrite",
+// "modTime" and "isExecutable" entries mirror the query parameters of a
+// regular PUT.
+//
+// Data is staged in the cache dir, and only written to the destination once
+// all of it has arrived, so an abandoned upload leaves the destination as it
+// was. Uploads that see no activity for tusUploadLifetime are discarded.
+
+const tusPrefix = "/gemdrive/tus/"
+const tusVersion = "1.0.0"
+const tusUploadLifetime = 24 * time.Hour
+
+type tusUpload struct {
+	Path         string `json:"path"`
+	Perm         string `json:"perm"`
+	Length       int64  `json:"length"`
+	Offset       int64  `json:"offset"`
+	Overwrite    bool   `json:"overwrite,omitempty"`
+	ModTime      string `json:"modTime,omitempty"`
+	IsExecutable bool   `json:"isExecutable,omitempty"`
+	ExpiresAt    string `json:"expiresAt"`
+}
+
+func (u *tusUpload) isExpired(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, u.ExpiresAt)
+	return err != nil || !now.Before(expiresAt)
+}
+
+func (s *Server) handleTus(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Tus-Resumable, Tus-Version, Tus-Extension")
+
+	if r.Method == "OPTIONS" {
+		header.Set("Tus-Version", tusVersion)
+		header.Set("Tus-Extension", "creation,termination")
+		w.WriteHeader(204)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		header.Set("Tus-Version", tusVersion)
+		w.WriteHeader(412)
+		io.WriteString(w, "Unsupported tus version")
+		return
+	}
+
+	token, _ := extractToken(r)
+
+	if token == "" {
+		token = "public"
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support writing")
+		return
+	}
+
+	uploadId := strings.TrimPrefix(r.URL.Path, tusPrefix)
+
+	if uploadId == "" {
+		if r.Method != "POST" {
+			w.WriteHeader(405)
+			return
+		}
+
+		s.tusCreate(w, r, token, mappedRoot, backend)
+		return
+	}
+
+	statePath, err := s.tusStatePath(uploadId)
+	if err != nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	// Only one request at a time may touch a given upload
+	lock, _ := s.tusLocks.LoadOrStore(uploadId, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	upload := &tusUpload{}
+	err = loadJson(upload, statePath)
+	if err == nil && upload.isExpired(time.Now()) {
+		s.tusDiscard(uploadId)
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		s.tusLocks.Delete(uploadId)
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	// Continuing takes the same permissions starting did, which for
+	// overwrites is more than just create
+	if !s.keyAuth.Can(token, upload.Path, upload.Perm) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		header.Set("Cache-Control", "no-store")
+		header.Set("Upload-Offset", fmt.Sprintf("%d", upload.Offset))
+		header.Set("Upload-Length", fmt.Sprintf("%d", upload.Length))
+	case "PATCH":
+		s.tusPatch(w, r, uploadId, upload, backend)
+	case "DELETE":
+		// Nothing has been written to the destination yet, so there's
+		// nothing to undo there.
+		s.tusDiscard(uploadId)
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) tusCreate(w http.ResponseWriter, r *http.Request, token, mappedRoot string, backend WritableBackend) {
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid Upload-Length")
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	destPath := metadata["path"]
+	if destPath == "" || !strings.HasPrefix(destPath, "/") {
+		w.WriteHeader(400)
+		io.WriteString(w, "Missing path in Upload-Metadata")
+		return
+	}
+
+	if strings.HasSuffix(destPath, "/") {
+		filename := metadata["filename"]
+		if filename == "" || strings.Contains(filename, "/") {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid filename in Upload-Metadata")
+			return
+		}
+		destPath += filename
+	}
+
+	destPath = mappedRoot + path.Clean(destPath)
+
+	overwrite := metadata["overwrite"] == "true"
+	eventType := s.writeEventType(destPath, overwrite)
+	perm := writePerm(eventType)
+
+	if !s.keyAuth.Can(token, destPath, perm) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	upload := &tusUpload{
+		Path:         destPath,
+		Perm:         perm,
+		Length:       length,
+		Overwrite:    overwrite,
+		ModTime:      metadata["modTime"],
+		IsExecutable: metadata["isExecutable"] == "true",
+	}
+
+	if upload.ModTime != "" {
+		_, err := time.Parse(time.RFC3339, upload.ModTime)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid modTime in Upload-Metadata")
+			return
+		}
+	}
+
+	// Report overwrite problems before any data is sent. Anything else
+	// the backend objects to only shows up once the upload is done.
+	if eventType == "create" {
+		if _, _, err := statItem(s.backend, destPath); err == nil {
+			w.WriteHeader(409)
+			io.WriteString(w, "File already exists")
+			return
+		}
+	}
+
+	uploadId, err := genRandomKey()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	statePath, _ := s.tusStatePath(uploadId)
+	dataPath, _ := s.tusDataPath(uploadId)
+
+	for _, dir := range []string{filepath.Dir(statePath), filepath.Dir(dataPath)} {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	dataFile, err := os.OpenFile(dataPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	dataFile.Close()
+
+	err = s.tusSave(uploadId, upload, backend)
+	if err != nil {
+		s.tusDiscard(uploadId)
+	}
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", tusPrefix+uploadId)
+	w.WriteHeader(201)
+}
+
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request, uploadId string, upload *tusUpload, backend WritableBackend) {
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(415)
+		io.WriteString(w, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid Upload-Offset")
+		return
+	}
+
+	if offset != upload.Offset {
+		w.WriteHeader(409)
+		io.WriteString(w, "Upload-Offset does not match")
+		return
+	}
+
+	if r.ContentLength < 0 {
+		w.WriteHeader(411)
+		io.WriteString(w, "Content-Length required")
+		return
+	}
+
+	if offset+r.ContentLength > upload.Length {
+		w.WriteHeader(413)
+		io.WriteString(w, "Data exceeds Upload-Length")
+		return
+	}
+
+	dataPath, _ := s.tusDataPath(uploadId)
+
+	written, writeErr := writeAt(dataPath, r.Body, offset, r.ContentLength)
+	upload.Offset += written
+
+	err = s.tusSave(uploadId, upload, backend)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if writeErr != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, writeErr.Error())
+		return
+	}
+
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%d", upload.Offset))
+	w.WriteHeader(204)
+}
+
+// writeAt writes length bytes of data to the file at offset, and returns how
+// many made it.
+func writeAt(filePath string, data io.Reader, offset, length int64) (int64, error) {
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.CopyN(file, data, length)
+	if err != nil {
+		return n, err
+	}
+
+	return n, file.Sync()
+}
+
+// tusSave persists the upload state, or writes the data to its destination
+// and cleans up once the upload is complete.
+func (s *Server) tusSave(uploadId string, upload *tusUpload, backend WritableBackend) error {
+
+	statePath, _ := s.tusStatePath(uploadId)
+
+	if upload.Offset < upload.Length {
+		upload.ExpiresAt = time.Now().Add(tusUploadLifetime).UTC().Format(time.RFC3339)
+		return saveJson(upload, statePath)
+	}
+
+	dataPath, _ := s.tusDataPath(uploadId)
+
+	dataFile, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+
+	eventType := s.writeEventType(upload.Path, upload.Overwrite)
+
+	err = backend.Write(upload.Path, dataFile, 0, upload.Length, upload.Overwrite, true)
+	dataFile.Close()
+	if err != nil {
+		// Kept so an empty PATCH can try again
+		upload.ExpiresAt = time.Now().Add(tusUploadLifetime).UTC().Format(time.RFC3339)
+		saveJson(upload, statePath)
+		return err
+	}
+
+	s.tusDiscard(uploadId)
+
+	s.emit(eventType, upload.Path)
+
+	if upload.ModTime != "" || upload.IsExecutable {
+		modTime, err := time.Parse(time.RFC3339, upload.ModTime)
+		if err != nil {
+			modTime = time.Now()
+		}
+
+		return backend.SetAttributes(upload.Path, modTime, upload.IsExecutable)
+	}
+
+	return nil
+}
+
+// tusDiscard removes everything kept for an upload.
+func (s *Server) tusDiscard(uploadId string) {
+
+	statePath, _ := s.tusStatePath(uploadId)
+	dataPath, _ := s.tusDataPath(uploadId)
+
+	os.Remove(statePath)
+	os.Remove(dataPath)
+
+	s.tusLocks.Delete(uploadId)
+}
+
+// pruneTusUploads discards uploads that have expired.
+func (s *Server) pruneTusUploads() {
+
+	statePaths, _ := filepath.Glob(filepath.Join(s.config.DataDir, "tus_uploads", "*.json"))
+
+	now := time.Now()
+
+	for _, statePath := range statePaths {
+		uploadId := strings.TrimSuffix(filepath.Base(statePath), ".json")
+
+		lock, _ := s.tusLocks.LoadOrStore(uploadId, &sync.Mutex{})
+		lock.(*sync.Mutex).Lock()
+
+		upload := &tusUpload{}
+		err := loadJson(upload, statePath)
+		if err == nil && upload.isExpired(now) {
+			s.tusDiscard(uploadId)
+		}
+
+		lock.(*sync.Mutex).Unlock()
+	}
+}
+
+func (s *Server) tusStatePath(uploadId string) (string, error) {
+	if !isRandomKey(uploadId) {
+		return "", fmt.Errorf("Invalid upload ID")
+	}
+	return filepath.Join(s.config.DataDir, "tus_uploads", uploadId+".json"), nil
+}
+
+func (s *Server) tusDataPath(uploadId string) (string, error) {
+	if !isRandomKey(uploadId) {
+		return "", fmt.Errorf("Invalid upload ID")
+	}
+	return filepath.Join(s.config.CacheDir, "tus_uploads", uploadId), nil
+}
+
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Upload-Metadata value for %s", parts[0])
+			}
+			value = string(decoded)
+		}
+
+		metadata[parts[0]] = value
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,150 @@
+package gemdrive
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func tusRequest(t *testing.T, method, reqUrl, key string, headers map[string]string, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, reqUrl, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func tusCreateUpload(t *testing.T, baseUrl, key, destPath string, length int) string {
+	t.Helper()
+
+	metadata := "path " + base64.StdEncoding.EncodeToString([]byte(destPath)) +
+		",overwrite " + base64.StdEncoding.EncodeToString([]byte("true"))
+
+	res := tusRequest(t, "POST", baseUrl+tusPrefix, key, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	}, "")
+	if res.StatusCode != 201 {
+		t.Fatalf("Creating upload: %d", res.StatusCode)
+	}
+
+	return baseUrl + res.Header.Get("Location")
+}
+
+func tusPatchUpload(t *testing.T, uploadUrl, key string, offset int, data string) {
+	t.Helper()
+
+	res := tusRequest(t, "PATCH", uploadUrl, key, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, data)
+	if res.StatusCode != 204 {
+		t.Fatalf("Patching upload: %d", res.StatusCode)
+	}
+}
+
+func TestTusLeavesDestinationAloneUntilComplete(t *testing.T) {
+
+	server, baseUrl, masterKey := newTestServer(t)
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "original")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	checkContent := func(expected string) {
+		t.Helper()
+		status, body := doRequest(t, "GET", baseUrl+"/a.txt", masterKey, "")
+		if status != 200 || body != expected {
+			t.Fatalf("Got %d %q, want %q", status, body, expected)
+		}
+	}
+
+	// Abandoned part way through
+	uploadUrl := tusCreateUpload(t, baseUrl, masterKey, "/a.txt", 11)
+	tusPatchUpload(t, uploadUrl, masterKey, 0, "replaced")
+	checkContent("original")
+
+	res := tusRequest(t, "DELETE", uploadUrl, masterKey, nil, "")
+	if res.StatusCode != 204 {
+		t.Fatalf("Deleting upload: %d", res.StatusCode)
+	}
+	checkContent("original")
+
+	uploadUrl = tusCreateUpload(t, baseUrl, masterKey, "/a.txt", 11)
+	tusPatchUpload(t, uploadUrl, masterKey, 0, "replaced")
+	tusPatchUpload(t, uploadUrl, masterKey, 8, " it")
+	checkContent("replaced it")
+
+	res = tusRequest(t, "HEAD", uploadUrl, masterKey, nil, "")
+	if res.StatusCode != 404 {
+		t.Fatalf("Completed upload still exists: %d", res.StatusCode)
+	}
+
+	locks := 0
+	server.tusLocks.Range(func(key, value interface{}) bool {
+		locks++
+		return true
+	})
+	if locks != 0 {
+		t.Fatalf("%d upload locks left over", locks)
+	}
+}
+
+func TestTusContinuingTakesTheCreatorsPermissions(t *testing.T) {
+
+	_, baseUrl, masterKey := newTestServer(t)
+
+	client, err := NewClient(baseUrl, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := doRequest(t, "PUT", baseUrl+"/a.txt", masterKey, "original")
+	if status != 200 {
+		t.Fatalf("Writing file: %d", status)
+	}
+
+	createKey, err := client.CreateKey(&KeyData{
+		Privileges: map[string]string{
+			"/": "create",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadUrl := tusCreateUpload(t, baseUrl, masterKey, "/a.txt", 8)
+
+	for _, method := range []string{"HEAD", "PATCH"} {
+		res := tusRequest(t, method, uploadUrl, createKey, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": "0",
+		}, "replaced")
+		if res.StatusCode != 403 {
+			t.Fatalf("%s with a create-only key: got %d, want 403", method, res.StatusCode)
+		}
+	}
+
+	status, body := doRequest(t, "GET", baseUrl+"/a.txt", masterKey, "")
+	if status != 200 || body != "original" {
+		t.Fatalf("Got %d %q, want the original", status, body)
+	}
+}
@@ -0,0 +1,131 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users are managed by the master key. Setting an existing user replaces
+// them, which logs out their sessions.
+
+func (s *Server) isMasterKey(key string) bool {
+	masterKeyId, err := s.db.GetMasterKeyId()
+	if err != nil {
+		return false
+	}
+
+	id, err := s.db.GetKeyId(key)
+	return err == nil && id == masterKeyId
+}
+
+func (s *Server) setUser(w http.ResponseWriter, r *http.Request, username string) {
+
+	key, _ := extractToken(r)
+
+	if !s.isMasterKey(key) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	if username == "" || strings.Contains(username, "/") {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid username")
+		return
+	}
+
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	var userReq UserRequest
+	err = json.Unmarshal(bodyJson, &userReq)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if userReq.Password == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "Missing password")
+		return
+	}
+
+	privileges := userReq.Privileges
+	if privileges == nil {
+		privileges = make(map[string]string)
+	}
+
+	for _, perm := range privileges {
+		if _, ok := parsePerms(perm); !ok {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid permission: "+perm)
+			return
+		}
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(userReq.Password), bcrypt.DefaultCost)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	userKey, err := genKey()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	masterKeyId, err := s.db.GetKeyId(key)
+	if err != nil {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	userKeyId, err := s.db.SetKeyData(userKey, &KeyData{
+		Parent:     masterKeyId,
+		Privileges: privileges,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	err = s.db.SetUser(username, &UserData{
+		PasswordHash: string(passwordHash),
+		KeyId:        userKeyId,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, username string) {
+
+	key, _ := extractToken(r)
+
+	if !s.isMasterKey(key) {
+		s.sendUnauthorized(w, r)
+		return
+	}
+
+	err := s.db.DeleteUser(username)
+	if err != nil {
+		w.WriteHeader(404)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
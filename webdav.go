@@ -0,0 +1,601 @@
+package gemdrive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const webdavPrefix = "/gemdrive/webdav"
+
+func (s *Server) handleWebDav(w http.ResponseWriter, r *http.Request, mappedRoot string) {
+
+	token, tokenErr := extractToken(r)
+
+	if token == "" {
+		token = "public"
+	}
+
+	if r.Method != "OPTIONS" {
+		davPath := strings.TrimPrefix(r.URL.Path, webdavPrefix)
+		if davPath == "" {
+			davPath = "/"
+		}
+
+		reqPath := mappedRoot + davPath
+
+		// This is only a first pass to decide whether to ask for
+		// credentials. The file system checks every operation in detail.
+		var allowed bool
+		switch r.Method {
+		case "GET", "HEAD", "POST":
+			allowed = s.keyAuth.CanRead(token, reqPath)
+		case "PUT", "MKCOL":
+			allowed = s.keyAuth.Can(token, reqPath, "create")
+		case "DELETE":
+			allowed = s.keyAuth.Can(token, reqPath, "delete")
+		case "COPY", "MOVE":
+			destPath, err := s.davDestination(r, mappedRoot)
+			if err != nil {
+				w.WriteHeader(400)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			if r.Method == "COPY" {
+				allowed = s.keyAuth.CanRead(token, reqPath)
+			} else {
+				allowed = s.keyAuth.Can(token, reqPath, "delete")
+			}
+
+			allowed = allowed && s.keyAuth.Can(token, destPath, "create")
+		default:
+			allowed = s.keyAuth.CanAccess(token, reqPath)
+		}
+
+		if !allowed {
+			if tokenErr != nil {
+				// Give WebDAV clients a chance to prompt for
+				// credentials. The password is used as the key.
+				w.Header().Del("Content-Type")
+				w.Header().Set("WWW-Authenticate", `Basic realm="GemDrive"`)
+				w.WriteHeader(401)
+				io.WriteString(w, "Unauthorized")
+				return
+			}
+
+			s.sendUnauthorized(w, r)
+			return
+		}
+	}
+
+	handler := &webdav.Handler{
+		Prefix: webdavPrefix,
+		FileSystem: &davFileSystem{
+			server:     s,
+			token:      token,
+			mappedRoot: mappedRoot,
+		},
+		LockSystem: s.davLocks,
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+func (s *Server) davDestination(r *http.Request, mappedRoot string) (string, error) {
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return "", errors.New("Missing Destination header")
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", errors.New("Invalid Destination header")
+	}
+
+	if !strings.HasPrefix(u.Path, webdavPrefix+"/") {
+		return "", errors.New("Destination outside of WebDAV root")
+	}
+
+	return mappedRoot + path.Clean(u.Path[len(webdavPrefix):]), nil
+}
+
+// davFileSystem adapts a Backend to webdav.FileSystem. It is created per
+// request so that every access can be checked against the caller's key.
+type davFileSystem struct {
+	server     *Server
+	token      string
+	mappedRoot string
+}
+
+func (fs *davFileSystem) fullPath(name string) string {
+	return fs.mappedRoot + name
+}
+
+func (fs *davFileSystem) writable() (WritableBackend, error) {
+	backend, ok := fs.server.backend.(WritableBackend)
+	if !ok {
+		return nil, os.ErrPermission
+	}
+	return backend, nil
+}
+
+func (fs *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	reqPath := fs.fullPath(name)
+
+	if !fs.server.keyAuth.Can(fs.token, reqPath, "create") {
+		return os.ErrPermission
+	}
+
+	backend, err := fs.writable()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = statItem(fs.server.backend, reqPath)
+	if err == nil {
+		return os.ErrExist
+	}
+
+	err = backend.MakeDir(dirPath(reqPath), false)
+	if err != nil {
+		return davError(err)
+	}
+
+	fs.server.emit("create", dirPath(reqPath))
+
+	return nil
+}
+
+func (fs *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	reqPath := fs.fullPath(name)
+
+	writeFlags := os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+
+	if flag&writeFlags == 0 {
+		if !fs.server.keyAuth.CanAccess(fs.token, reqPath) {
+			return nil, os.ErrPermission
+		}
+
+		item, isDir, err := statItem(fs.server.backend, reqPath)
+		if err != nil {
+			return nil, davError(err)
+		}
+
+		// Directories are checked for list when they're read
+		if !isDir && !fs.server.keyAuth.CanRead(fs.token, reqPath) {
+			return nil, os.ErrPermission
+		}
+
+		return &davFile{
+			fs:    fs,
+			path:  reqPath,
+			name:  path.Base(name),
+			item:  item,
+			isDir: isDir,
+		}, nil
+	}
+
+	backend, err := fs.writable()
+	if err != nil {
+		return nil, err
+	}
+
+	item, isDir, err := statItem(fs.server.backend, reqPath)
+	exists := err == nil
+
+	// The whole file is rewritten on close, so changing an existing
+	// file amounts to replacing it.
+	required := "create"
+	if exists {
+		required = "create,delete"
+	}
+
+	if !fs.server.keyAuth.Can(fs.token, reqPath, required) {
+		return nil, os.ErrPermission
+	}
+
+	if exists && isDir {
+		return nil, os.ErrInvalid
+	}
+
+	if exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Writes are buffered to a temporary file and sent to the backend
+	// when the file is closed, since the backend needs to know the length
+	// up front.
+	tmpFile, err := ioutil.TempFile(fs.server.config.CacheDir, "webdav-")
+	if err != nil {
+		return nil, err
+	}
+
+	if exists && flag&os.O_TRUNC == 0 {
+		_, data, err := fs.server.backend.Read(reqPath, 0, 0)
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return nil, davError(err)
+		}
+
+		_, err = io.Copy(tmpFile, data)
+		data.Close()
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return nil, err
+		}
+
+		if flag&os.O_APPEND == 0 {
+			tmpFile.Seek(0, io.SeekStart)
+		}
+	}
+
+	if item == nil {
+		item = &Item{}
+	}
+
+	return &davFile{
+		fs:      fs,
+		path:    reqPath,
+		name:    path.Base(name),
+		item:    item,
+		backend: backend,
+		tmpFile: tmpFile,
+		exists:  exists,
+	}, nil
+}
+
+func (fs *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	reqPath := fs.fullPath(name)
+
+	if !fs.server.keyAuth.CanRecursive(fs.token, reqPath, "delete") {
+		return os.ErrPermission
+	}
+
+	backend, err := fs.writable()
+	if err != nil {
+		return err
+	}
+
+	_, isDir, err := statItem(fs.server.backend, reqPath)
+	if err != nil {
+		return davError(err)
+	}
+
+	if isDir {
+		reqPath = dirPath(reqPath)
+	}
+
+	err = backend.Delete(reqPath, true)
+	if err != nil {
+		return davError(err)
+	}
+
+	fs.server.emit("delete", reqPath)
+
+	return nil
+}
+
+func (fs *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath := fs.fullPath(oldName)
+	newPath := fs.fullPath(newName)
+
+	if !fs.server.keyAuth.CanRecursive(fs.token, oldPath, "delete") || !fs.server.keyAuth.CanRecursive(fs.token, newPath, "create") {
+		return os.ErrPermission
+	}
+
+	_, err := fs.writable()
+	if err != nil {
+		return err
+	}
+
+	// The webdav package has already removed the destination if
+	// overwriting was requested.
+	err = moveItem(fs.server.backend, oldPath, newPath, false)
+	if err != nil {
+		return davError(err)
+	}
+
+	fs.server.emitRename(oldPath, newPath)
+
+	return nil
+}
+
+func (fs *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	reqPath := fs.fullPath(name)
+
+	if !fs.server.keyAuth.CanAccess(fs.token, reqPath) {
+		return nil, os.ErrPermission
+	}
+
+	item, isDir, err := statItem(fs.server.backend, reqPath)
+	if err != nil {
+		return nil, davError(err)
+	}
+
+	return &davFileInfo{
+		name:  path.Base(name),
+		item:  item,
+		isDir: isDir,
+	}, nil
+}
+
+type davFile struct {
+	fs     *davFileSystem
+	path   string
+	name   string
+	item   *Item
+	isDir  bool
+	offset int64
+	reader io.ReadCloser
+
+	dirPos  int
+	backend WritableBackend
+	tmpFile *os.File
+	exists  bool
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.tmpFile != nil {
+		return f.tmpFile.Read(p)
+	}
+
+	if f.isDir {
+		return 0, os.ErrInvalid
+	}
+
+	if f.offset >= f.item.Size {
+		return 0, io.EOF
+	}
+
+	if f.reader == nil {
+		_, data, err := f.fs.server.backend.Read(f.path, f.offset, 0)
+		if err != nil {
+			return 0, davError(err)
+		}
+		f.reader = data
+	}
+
+	n, err := f.reader.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.tmpFile != nil {
+		return f.tmpFile.Seek(offset, whence)
+	}
+
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = f.offset + offset
+	case io.SeekEnd:
+		newOffset = f.item.Size + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if newOffset < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	if newOffset != f.offset && f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+
+	f.offset = newOffset
+
+	return f.offset, nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, os.ErrInvalid
+	}
+
+	if !f.fs.server.keyAuth.Can(f.fs.token, dirPath(f.path), "list") {
+		return nil, os.ErrPermission
+	}
+
+	listing, err := f.fs.server.backend.List(dirPath(f.path), 1)
+	if err != nil {
+		return nil, davError(err)
+	}
+
+	names := []string{}
+	for name := range listing.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := []os.FileInfo{}
+	for _, name := range names {
+		childPath := dirPath(f.path) + name
+		// Entries the caller has no access to are hidden rather
+		// than failing the whole listing.
+		if !f.fs.server.keyAuth.CanAccess(f.fs.token, childPath) {
+			continue
+		}
+
+		infos = append(infos, &davFileInfo{
+			name:  strings.TrimSuffix(name, "/"),
+			item:  listing.Children[name],
+			isDir: strings.HasSuffix(name, "/"),
+		})
+	}
+
+	if count <= 0 {
+		return infos, nil
+	}
+
+	if f.dirPos >= len(infos) {
+		return nil, io.EOF
+	}
+
+	end := f.dirPos + count
+	if end > len(infos) {
+		end = len(infos)
+	}
+
+	page := infos[f.dirPos:end]
+	f.dirPos = end
+
+	return page, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	if f.tmpFile != nil {
+		stat, err := f.tmpFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		return &davFileInfo{
+			name: f.name,
+			item: &Item{
+				Size:         stat.Size(),
+				ModTime:      stat.ModTime().UTC().Format(time.RFC3339),
+				IsExecutable: f.item.IsExecutable,
+			},
+		}, nil
+	}
+
+	return &davFileInfo{
+		name:  f.name,
+		item:  f.item,
+		isDir: f.isDir,
+	}, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.tmpFile == nil {
+		return 0, os.ErrPermission
+	}
+
+	return f.tmpFile.Write(p)
+}
+
+func (f *davFile) Close() error {
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+
+	if f.tmpFile == nil {
+		return nil
+	}
+
+	tmpFile := f.tmpFile
+	f.tmpFile = nil
+
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	stat, err := tmpFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = f.backend.Write(f.path, tmpFile, 0, stat.Size(), true, true)
+	if err != nil {
+		return davError(err)
+	}
+
+	if f.exists {
+		f.fs.server.emit("modify", f.path)
+	} else {
+		f.fs.server.emit("create", f.path)
+	}
+
+	return nil
+}
+
+type davFileInfo struct {
+	name  string
+	item  *Item
+	isDir bool
+}
+
+func (i *davFileInfo) Name() string {
+	return i.name
+}
+
+func (i *davFileInfo) Size() int64 {
+	return i.item.Size
+}
+
+func (i *davFileInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | 0755
+	}
+
+	if i.item.IsExecutable {
+		return 0755
+	}
+
+	return 0644
+}
+
+func (i *davFileInfo) ModTime() time.Time {
+	modTime, err := time.Parse(time.RFC3339, i.item.ModTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return modTime
+}
+
+func (i *davFileInfo) IsDir() bool {
+	return i.isDir
+}
+
+func (i *davFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Translate backend errors into the os errors the webdav package knows how
+// to turn into status codes.
+func davError(err error) error {
+	if e, ok := err.(*Error); ok {
+		switch e.HttpCode {
+		case 403:
+			return os.ErrPermission
+		case 404:
+			return os.ErrNotExist
+		case 409:
+			return os.ErrExist
+		}
+	}
+	return err
+}
+
+func dirPath(reqPath string) string {
+	if strings.HasSuffix(reqPath, "/") {
+		return reqPath
+	}
+	return reqPath + "/"
+}